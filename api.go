@@ -1,55 +1,502 @@
 package api
 
 import (
+	"fmt"
 	"reflect"
+	"strings"
+	"sync"
 )
 
 type function interface{}
 
-var Map = make(map[function][]*functionCall)
+// lock guards the registries and the rest of the package state since
+// instrumented functions can be called from any goroutine
+var lock sync.Mutex
+
+// the stubs, the calls journal and the strict mode settings, the package
+// level functions use the global registry and each Scope has its own
+type registry struct {
+	stubs           map[function][]*functionCall
+	journal         []*Call
+	strictReporter  TestReporter
+	strictFunctions map[interface{}]TestReporter
+}
+
+func newRegistry() *registry {
+	return &registry{
+		stubs:           make(map[function][]*functionCall),
+		journal:         make([]*Call, 0),
+		strictFunctions: make(map[interface{}]TestReporter),
+	}
+}
+
+var global = newRegistry()
 
 type functionCall struct {
-	args   []Matcher
-	values []interface{}
+	fun       function
+	reporter  TestReporter // used to report stubbing errors, panic if nil
+	file      string       // the call site of When
+	line      int
+	args      []Matcher
+	responses []*response
+	used      int  // number of times the stub matched a call
+	limit     int  // maximum number of times the stub can be used
+	limited   bool // true if the stub can only be used limit times
+}
+
+// what the stub does when it's used, either return values, call answer,
+// call the real implementation or panic
+type response struct {
+	values     []interface{}
+	answer     reflect.Value
+	callReal   bool
+	process    func([]interface{}) []interface{}
+	panics     bool
+	panicValue interface{}
+}
+
+// the instantiations of a generic function are closures that differ
+// between the instrumented function and the test, e.g. Map[T] and
+// Map[int], so they are identified by their name and type instead
+type genericFunction struct {
+	name    string
+	funType reflect.Type
 }
 
 func getFunType(fun function) interface{} {
+	if name := funcName(fun); strings.Contains(name, "[...]") {
+		return genericFunction{name, reflect.TypeOf(fun)}
+	}
 	return reflect.ValueOf(fun)
 }
 
-var mocking = false
-var lastFunctionCall *functionCall
+// a goroutine running Mock or Verifying, calls made from that goroutine
+// are recorded instead of being executed
+type recorder struct {
+	registry         *registry
+	verifier         TestReporter // nil if the goroutine is running Mock
+	reporter         TestReporter // used to report stubbing errors
+	created          []*functionCall
+	lastFunctionCall *functionCall
+	lastVerification *verification
+}
+
+var recorders = make(map[int64]*recorder)
+
+func startRecording(r *recorder) int64 {
+	lock.Lock()
+	defer lock.Unlock()
+	goroutine := goroutineID()
+	recorders[goroutine] = r
+	return goroutine
+}
+
+func stopRecording(goroutine int64) {
+	lock.Lock()
+	defer lock.Unlock()
+	delete(recorders, goroutine)
+}
+
+// Stop recording the calls made from the current goroutine until the
+// returned function is called. The matchers are user code that may call
+// instrumented functions while mock4go checks the verifications, those
+// calls must run instead of being recorded
+func pauseRecording() func() {
+	lock.Lock()
+	defer lock.Unlock()
+	goroutine := goroutineID()
+	r := recorders[goroutine]
+	delete(recorders, goroutine)
+	return func() {
+		lock.Lock()
+		defer lock.Unlock()
+		if r != nil {
+			recorders[goroutine] = r
+		}
+	}
+}
+
+func currentRecorder() *recorder {
+	lock.Lock()
+	defer lock.Unlock()
+	if r := recorders[goroutineID()]; r != nil {
+		return r
+	}
+	return &recorder{}
+}
+
+func (r *recorder) record(funType interface{}, fun function, args []interface{}) {
+	call := &functionCall{
+		fun:      fun,
+		reporter: r.reporter,
+		args:     argsMatchers(expandArgs(fun, nil, args)),
+	}
+	if r.verifier == nil {
+		r.lastFunctionCall = call
+		r.created = append(r.created, call)
+		r.registry.addFunctionCall(funType, call)
+		return
+	}
+	r.lastVerification = &verification{
+		registry: r.registry,
+		funType:  funType,
+		fun:      fun,
+		call:     call,
+		reporter: r.verifier,
+	}
+}
 
 func Mock(fun func()) {
-	mocking = true
+	defer stopRecording(startRecording(&recorder{registry: global}))
 	fun()
-	mocking = false
+}
+
+// TB is the part of testing.TB used by MockT and NewScope, the package
+// doesn't import testing so instrumented binaries don't get its flags
+type TB interface {
+	TestReporter
+	Helper()
+	Cleanup(func())
+}
+
+// Same as Mock but the stubs are removed when the test finishes and
+// stubbing errors are reported using t.Errorf instead of panicking, e.g.
+//
+//	MockT(t, func() {
+//		When(Foo()).Return("bar")
+//	})
+func MockT(t TB, fun func()) {
+	t.Helper()
+	r := &recorder{registry: global, reporter: t}
+	lock.Lock()
+	var last *Call
+	if len(global.journal) > 0 {
+		last = global.journal[len(global.journal)-1]
+	}
+	lock.Unlock()
+	func() {
+		defer stopRecording(startRecording(r))
+		fun()
+	}()
+	t.Cleanup(func() {
+		lock.Lock()
+		defer lock.Unlock()
+		global.removeStubs(r.created)
+		global.removeCallsAfter(last)
+		global.removeStrict(t)
+	})
 }
 
 func When(args ...interface{}) *functionCall {
-	return lastFunctionCall
+	r := currentRecorder()
+	file, line := caller(1)
+	lock.Lock()
+	call := r.lastFunctionCall
+	// a call to a function that isn't instrumented mustn't stub the
+	// previous one again
+	r.lastFunctionCall = nil
+	lock.Unlock()
+	if call == nil {
+		// the stub isn't registered, its methods don't report anything
+		// else since it has no function
+		call = &functionCall{reporter: r.reporter, file: file, line: line}
+		call.fail("%sWhen: no instrumented call recorded", call.location())
+		return call
+	}
+	return call.update(func() {
+		call.file, call.line = file, line
+	})
+}
+
+// apply the given change to the stub while holding the lock
+func (m *functionCall) update(change func()) *functionCall {
+	lock.Lock()
+	defer lock.Unlock()
+	change()
+	return m
 }
 
 func (m *functionCall) Return(values ...interface{}) *functionCall {
-	m.values = values
+	values, ok := m.validateValues("Return", values)
+	if !ok {
+		return m
+	}
+	return m.update(func() {
+		m.responses = []*response{{values: values}}
+	})
+}
+
+// Add the given values to the sequence of values returned by the stub.
+// Each call uses the next values in the sequence and the last values are
+// returned once the sequence is exhausted, e.g.
+//
+//	When(Foo()).Return(nil, err).ThenReturn(nil, err).ThenReturn(value, nil)
+func (m *functionCall) ThenReturn(values ...interface{}) *functionCall {
+	values, ok := m.validateValues("ThenReturn", values)
+	if !ok {
+		return m
+	}
+	return m.update(func() {
+		m.responses = append(m.responses, &response{values: values})
+	})
+}
+
+// Return the given error from every result of type error and the zero
+// value from the other results, e.g. ReturnError(err) is the same as
+// Return("", 0, err) for a function that returns (string, int, error)
+func (m *functionCall) ReturnError(err error) *functionCall {
+	if values, ok := m.errorValues("ReturnError", err); ok {
+		m.Return(values...)
+	}
 	return m
 }
 
+// Same as ReturnError but adds the values to the sequence of values
+// returned by the stub
+func (m *functionCall) ThenReturnError(err error) *functionCall {
+	if values, ok := m.errorValues("ThenReturnError", err); ok {
+		m.ThenReturn(values...)
+	}
+	return m
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+func (m *functionCall) errorValues(name string, err error) ([]interface{}, bool) {
+	if m.fun == nil {
+		return nil, false
+	}
+	funType := reflect.TypeOf(m.fun)
+	values := ZeroValues(m.fun)
+	found := false
+	for i := 0; i < funType.NumOut(); i++ {
+		if funType.Out(i) == errorType {
+			values[i] = err
+			found = true
+		}
+	}
+	if !found {
+		m.fail("%s: %s doesn't return an error", name, funcName(m.fun))
+	}
+	return values, found
+}
+
+// report a stubbing error, must be called without holding the lock
+func (m *functionCall) fail(format string, args ...interface{}) {
+	if m.reporter == nil {
+		panic(fmt.Sprintf(format, args...))
+	}
+	m.reporter.Errorf(format, args...)
+}
+
+// Panic with the given value when the stub is used
+func (m *functionCall) Panic(value interface{}) *functionCall {
+	return m.update(func() {
+		m.responses = []*response{{panics: true, panicValue: value}}
+	})
+}
+
+// Same as ThenReturn but panics with the given value
+func (m *functionCall) ThenPanic(value interface{}) *functionCall {
+	return m.update(func() {
+		m.responses = append(m.responses, &response{panics: true, panicValue: value})
+	})
+}
+
+// Return the given values once then fall through to the next stub or the
+// real implementation
+func (m *functionCall) ReturnOnce(values ...interface{}) *functionCall {
+	return m.Return(values...).Times(1)
+}
+
+// Use the given function to compute the return values. The function
+// must have the same signature as the stubbed function, methods take the
+// receiver as their first argument, e.g.
+//
+//	When(foo.Bar("")).Do(func(f *Foo, s string) string { ... })
+func (m *functionCall) Do(answer interface{}) *functionCall {
+	r, ok := m.newAnswer("Do", answer)
+	if !ok {
+		return m
+	}
+	return m.update(func() {
+		m.responses = []*response{r}
+	})
+}
+
+// Same as ThenReturn but uses the given function to compute the return values
+func (m *functionCall) ThenDo(answer interface{}) *functionCall {
+	r, ok := m.newAnswer("ThenDo", answer)
+	if !ok {
+		return m
+	}
+	return m.update(func() {
+		m.responses = append(m.responses, r)
+	})
+}
+
+func (m *functionCall) newAnswer(name string, answer interface{}) (*response, bool) {
+	if m.fun == nil {
+		return nil, false
+	}
+	funType := reflect.TypeOf(m.fun)
+	answerType := reflect.TypeOf(answer)
+	if answerType != funType {
+		m.fail("%s: expected a function of type %s but got %s", name, funType, answerType)
+		return nil, false
+	}
+	return &response{answer: reflect.ValueOf(answer)}, true
+}
+
+// Stop matching calls after the stub was used n times, the calls after
+// that fall through to the next stub or the real implementation
+func (m *functionCall) Times(n int) *functionCall {
+	return m.update(func() {
+		m.limit = n
+		m.limited = true
+	})
+}
+
+// must be called while holding the lock
+func (m *functionCall) exhausted() bool {
+	return m.limited && m.used >= m.limit
+}
+
+// Returns the next response of the stub and false if the stub is
+// exhausted, must be called while holding the lock
+func (m *functionCall) use() (response, bool) {
+	if m.exhausted() {
+		return response{}, false
+	}
+	m.used++
+	if len(m.responses) == 0 {
+		return response{}, true
+	}
+	idx := m.used - 1
+	if idx >= len(m.responses) {
+		idx = len(m.responses) - 1
+	}
+	return *m.responses[idx], true
+}
+
+func (r response) returnValues(call *Call, args []interface{}) []interface{} {
+	if r.panics {
+		lock.Lock()
+		call.Panicked = true
+		call.Panic = r.panicValue
+		lock.Unlock()
+		panic(r.panicValue)
+	}
+	if r.callReal {
+		return callRealFunction(call, args, r.process)
+	}
+	if !r.answer.IsValid() {
+		if r.values == nil {
+			// the stub doesn't have a Return clause
+			return ZeroValues(call.fun)
+		}
+		return r.values
+	}
+	return callFunction(r.answer, args)
+}
+
+// call the given function using reflection and return its results
+func callFunction(fun reflect.Value, args []interface{}) []interface{} {
+	funType := fun.Type()
+	in := make([]reflect.Value, 0, len(args))
+	for idx, arg := range args {
+		if arg == nil {
+			in = append(in, reflect.Zero(funType.In(idx)))
+		} else {
+			in = append(in, reflect.ValueOf(arg))
+		}
+	}
+	var out []reflect.Value
+	if funType.IsVariadic() {
+		out = fun.CallSlice(in)
+	} else {
+		out = fun.Call(in)
+	}
+	values := make([]interface{}, 0, len(out))
+	for _, value := range out {
+		values = append(values, value.Interface())
+	}
+	return values
+}
+
 type Matcher interface {
 	Matches(interface{}) bool
 }
 
 func (m *functionCall) WithMatchers(matchers ...Matcher) *functionCall {
-	if len(m.args) > len(matchers) {
-		m.args = append(matchers, m.args[len(matchers):]...)
-	} else {
-		m.args = matchers
+	return m.update(func() {
+		if len(m.args) > len(matchers) && !endsWithVariadic(matchers) {
+			m.args = append(matchers, m.args[len(matchers):]...)
+		} else {
+			m.args = matchers
+		}
+	})
+}
+
+// must be called while holding the lock
+func (r *registry) addFunctionCall(funType interface{}, call *functionCall) {
+	r.stubs[funType] = append(r.stubs[funType], call)
+}
+
+// must be called while holding the lock
+func (r *registry) removeStubs(removed []*functionCall) {
+	for _, stub := range removed {
+		funType := getFunType(stub.fun)
+		remaining := make([]*functionCall, 0, len(r.stubs[funType]))
+		for _, other := range r.stubs[funType] {
+			if other != stub {
+				remaining = append(remaining, other)
+			}
+		}
+		if len(remaining) == 0 {
+			delete(r.stubs, funType)
+		} else {
+			r.stubs[funType] = remaining
+		}
 	}
-	return m
 }
 
-func addFunctionCall(funType interface{}, call *functionCall) {
-	Map[funType] = append(Map[funType], call)
+// must be called without holding the lock, the matchers are user code
+// that may call instrumented functions
+func (m *functionCall) String() string {
+	lock.Lock()
+	fun, matchers := m.fun, m.args
+	lock.Unlock()
+	return fmt.Sprintf("%s(%s)", funcName(fun), describeMatchers(matchers))
+}
+
+// nil matchers match any arguments, e.g. the stubs created by Spy
+func matchArgs(matchers []Matcher, args []interface{}) bool {
+	if matchers == nil {
+		return true
+	}
+	if len(matchers) != len(args) {
+		return false
+	}
+	for idx, matcher := range matchers {
+		if !matcher.Matches(args[idx]) {
+			return false
+		}
+	}
+	return true
+}
+
+func argsMatchers(args []interface{}) []Matcher {
+	matchers := make([]Matcher, 0)
+	for _, arg := range args {
+		argType := reflect.TypeOf(arg)
+		if argType != nil && argType.Kind() == reflect.Ptr {
+			matchers = append(matchers, &EqualsMatcher{value: arg})
+		} else {
+			matchers = append(matchers, &DeepEqualMatcher{value: arg})
+		}
+	}
+	return matchers
 }
 
 func ZeroValues(fun function) []interface{} {
@@ -61,62 +508,119 @@ func ZeroValues(fun function) []interface{} {
 	return values
 }
 
+// Matches the arguments that are the same pointer as value, it's used for
+// the pointer arguments, e.g. a stub of foo.Bar() doesn't match the calls
+// on another *Foo equal to foo
 type EqualsMatcher struct {
 	value interface{}
 }
 
 func (m *EqualsMatcher) Matches(other interface{}) bool {
-	return reflect.DeepEqual(m.value, other)
+	return m.value == other
 }
 
+// Matches the arguments that are deeply equal to value, it's used for the
+// arguments that aren't pointers, e.g. slices and maps
 type DeepEqualMatcher struct {
 	value interface{}
 }
 
 func (m *DeepEqualMatcher) Matches(other interface{}) bool {
-	return m.value == other
+	return reflect.DeepEqual(m.value, other)
 }
 
 // Returns the (return values, true, nil) if the method/function is mocked
 // and the args match the expected values. Otherwise, it returns (nil, true, nil)
 // if there was an error this function returns (nil, false, error)
 func FunctionCalled(fun function, args ...interface{}) ([]interface{}, bool, error) {
+	return functionCalled(fun, false, args)
+}
+
+// Same as FunctionCalled but the first argument is the method receiver
+func MethodCalled(fun function, recv interface{}, args ...interface{}) ([]interface{}, bool, error) {
+	return functionCalled(fun, true, append([]interface{}{recv}, args...))
+}
+
+type bypassKey struct {
+	goroutine int64
+	funType   interface{}
+}
+
+// a stub and its matchers at the time of the call
+type candidate struct {
+	stub *functionCall
+	args []Matcher
+}
+
+func functionCalled(fun function, hasReceiver bool, args []interface{}) ([]interface{}, bool, error) {
 	funType := getFunType(fun)
-	if mocking {
-		argsMatchers := make([]Matcher, 0)
-
-		for _, arg := range args {
-			argType := reflect.TypeOf(arg)
-			if argType.Kind() == reflect.Ptr {
-				argsMatchers = append(argsMatchers, &EqualsMatcher{value: arg})
-			} else {
-				argsMatchers = append(argsMatchers, &DeepEqualMatcher{value: arg})
+
+	lock.Lock()
+	registry := global
+	if len(recorders) > 0 || len(bypass) > 0 || len(scopes) > 0 {
+		goroutine := goroutineID()
+		key := bypassKey{goroutine, funType}
+		if bypass[key] > 0 {
+			// this is the real implementation being called by callRealFunction
+			if bypass[key]--; bypass[key] == 0 {
+				delete(bypass, key)
 			}
+			lock.Unlock()
+			return nil, false, nil
 		}
-
-		lastFunctionCall = &functionCall{
-			args: argsMatchers,
+		if r := recorders[goroutine]; r != nil {
+			r.record(funType, fun, args)
+			lock.Unlock()
+			return ZeroValues(fun), true, nil
 		}
-		addFunctionCall(funType, lastFunctionCall)
-		return ZeroValues(fun), true, nil
+		registry = registryFor()
 	}
-	calls := Map[funType]
-outer:
-	for _, call := range calls {
-		if len(call.args) > len(args) {
+	call := newCall(funType, fun, hasReceiver, args)
+	registry.journal = append(registry.journal, call)
+	candidates := make([]candidate, 0, len(registry.stubs[funType]))
+	for _, stub := range registry.stubs[funType] {
+		candidates = append(candidates, candidate{stub, stub.args})
+	}
+	lock.Unlock()
+
+	// the matchers are user code that may call instrumented functions, so
+	// they are called without holding the lock
+	for _, candidate := range candidates {
+		matched := call.matchedArguments(candidate.args)
+		if !matchArgs(candidate.args, matched) {
 			continue
 		}
-		for idx, arg := range call.args {
-			if !arg.Matches(args[idx]) {
-				continue outer
-			}
+		lock.Lock()
+		response, ok := candidate.stub.use()
+		if ok {
+			call.Matched = true
+			call.Stub = candidate.stub
+		}
+		lock.Unlock()
+		if !ok {
+			continue
+		}
+		captureArgs(candidate.args, matched)
+		values := response.returnValues(call, args)
+		lock.Lock()
+		call.Returned = values
+		lock.Unlock()
+		return values, true, nil
+	}
+
+	if len(candidates) > 0 {
+		if reporter, message := registry.unmatchedCall(funType, call); reporter != nil {
+			reporter.Errorf("%s", message)
+			return ZeroValues(fun), true, nil
 		}
-		return call.values, true, nil
 	}
-	// what should we do here
 	return nil, false, nil
 }
 
+// Remove the stubs, the recorded calls and the strict mode settings
+// of the global registry, scopes aren't affected
 func ResetMocks() {
-	Map = make(map[function][]*functionCall)
+	lock.Lock()
+	defer lock.Unlock()
+	global = newRegistry()
 }
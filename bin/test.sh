@@ -26,6 +26,35 @@ function test_package {
     return $status
 }
 
+function test_toolexec {
+    go build -o $destination/toolexec/mock4go mock4go/mock4go.go && \
+        go test -count=1 -toolexec=$destination/toolexec/mock4go "$@" && \
+        GOFLAGS="$GOFLAGS -toolexec=$destination/toolexec/mock4go" go test -count=1 "$@" && \
+        go test -count=1 -toolexec=$destination/toolexec/mock4go -gcflags='all=-N -l' "$@"
+    status=$?
+    rm -rf $destination/toolexec
+    return $status
+}
+
+# run the tests of the workspace in testdata/modules with mock4go in module
+# mode, once from a package directory and once with GOWORK set. The
+# workspace uses a copy of mock4go with a go.mod
+function test_module {
+    modules=$destination/modules
+    cp -r testdata/modules $modules && \
+        mkdir -p $modules/mock4go && \
+        cp *.go $modules/mock4go/ && \
+        rm $modules/mock4go/*_test.go && \
+        printf 'module github.com/jvshahid/mock4go\n\ngo 1.21\n' > $modules/mock4go/go.mod && \
+        go build -o $modules/bin/mock4go mock4go/mock4go.go && \
+        (cd $modules/workspace && GO111MODULE=on go work use $modules/mock4go) && \
+        (cd $modules/workspace/app/greet && GO111MODULE=on GOPROXY=off $modules/bin/mock4go go test -count=1 -- ./...) && \
+        (cd $modules/workspace/app && GO111MODULE=on GOPROXY=off GOWORK=$modules/workspace/go.work $modules/bin/mock4go go test -count=1 -- ./greet)
+    status=$?
+    rm -rf $modules
+    return $status
+}
+
 if [ "x$TMPDIR" == "x" ]; then
     TMPDIR=/tmp
 fi
@@ -37,7 +66,10 @@ function cleanup {
 
 trap cleanup EXIT
 
-if ! (test_package test && test_package testc && test_package testnomock && \
+if ! (go test github.com/jvshahid/mock4go github.com/jvshahid/mock4go/matchers && test_package go test -race -- test && test_package testc && test_package testnomock && \
+        test_package -o go test -- test && \
+        test_toolexec test testc testnomock && \
+        test_module && \
         test_package -i -k -d $destination test_failing); then
     echo "************************* TEST FAILED *******************************"
     exit 1
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"sync"
+)
+
+// Captor is a Matcher that matches any value and records the arguments
+// of the calls that matched the stub or verification it was used in, e.g.
+//
+//	captor := &Captor{}
+//	Mock(func() {
+//		When(Foo(nil)).WithMatchers(captor).Return("bar")
+//	})
+//	...
+//	request := captor.Last().(*Request)
+type Captor struct {
+	lock   sync.Mutex
+	values []interface{}
+}
+
+func NewCaptor() *Captor {
+	return &Captor{}
+}
+
+func (c *Captor) Matches(interface{}) bool {
+	return true
+}
+
+func (c *Captor) Describe() string {
+	return "<captor>"
+}
+
+func (c *Captor) capture(value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.values = append(c.values, value)
+}
+
+// Returns the last captured value or nil if no values were captured
+func (c *Captor) Last() interface{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.values) == 0 {
+		return nil
+	}
+	return c.values[len(c.values)-1]
+}
+
+// Returns all the captured values in the order they were captured
+func (c *Captor) All() []interface{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]interface{}{}, c.values...)
+}
+
+// the captors only record the arguments once all the matchers matched
+func captureArgs(matchers []Matcher, args []interface{}) {
+	for idx, matcher := range matchers {
+		if captor, ok := matcher.(*Captor); ok {
+			captor.capture(args[idx])
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package api
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// DescribedMatcher can be implemented by a Matcher to describe the values
+// it matches in the failure messages
+type DescribedMatcher interface {
+	Matcher
+	Describe() string
+}
+
+// ExplainedMatcher can be implemented by a Matcher to explain why the
+// given value doesn't match in the failure messages
+type ExplainedMatcher interface {
+	Matcher
+	Explain(actual interface{}) string
+}
+
+func describeMatcher(matcher Matcher) string {
+	switch m := matcher.(type) {
+	case DescribedMatcher:
+		return m.Describe()
+	case *EqualsMatcher:
+		return fmt.Sprintf("%#v", m.value)
+	case *DeepEqualMatcher:
+		return fmt.Sprintf("%#v", m.value)
+	case fmt.Stringer:
+		return m.String()
+	}
+	return fmt.Sprintf("%#v", matcher)
+}
+
+func describeMatchers(matchers []Matcher) string {
+	descriptions := make([]string, 0, len(matchers))
+	for _, matcher := range matchers {
+		descriptions = append(descriptions, describeMatcher(matcher))
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+// Returns one line per argument of the call that doesn't match its
+// matcher, each line has the expectation next to the actual argument and
+// is followed by the structural differences if the matcher compares values
+func explainMismatches(matchers []Matcher, call *Call) []string {
+	args := call.matchedArguments(matchers)
+	if matchers == nil {
+		return nil
+	}
+	if len(matchers) != len(args) {
+		return []string{fmt.Sprintf("expected %d arguments, got %d", len(matchers), len(args))}
+	}
+	lines := make([]string, 0)
+	for idx, matcher := range matchers {
+		actual := args[idx]
+		if matcher.Matches(actual) {
+			continue
+		}
+		name := fmt.Sprintf("argument %d", idx)
+		if call.hasReceiver {
+			name = fmt.Sprintf("argument %d", idx-1)
+			if idx == 0 {
+				name = "receiver"
+			}
+		}
+		lines = append(lines, fmt.Sprintf("%s: expected %s, got %#v", name, describeMatcher(matcher), actual))
+		for _, line := range explainMismatch(matcher, actual) {
+			lines = append(lines, "    "+line)
+		}
+	}
+	return lines
+}
+
+func explainMismatch(matcher Matcher, actual interface{}) []string {
+	switch m := matcher.(type) {
+	case ExplainedMatcher:
+		if explanation := m.Explain(actual); explanation != "" {
+			return []string{explanation}
+		}
+	case *DeepEqualMatcher:
+		return diff(m.value, actual)
+	case *variadicMatcher:
+		return explainMismatch(m.matcher, actual)
+	}
+	return nil
+}
+
+// Returns the differences between the expected and actual values, one
+// line per difference prefixed with the path to the value that differs,
+// e.g. `.Field[2]: expected "foo", got "bar"`. Only structs, maps, slices
+// and arrays are compared, nil is returned for the other values
+func diff(expected, actual interface{}) []string {
+	e, a := reflect.ValueOf(expected), reflect.ValueOf(actual)
+	if !e.IsValid() || !a.IsValid() || e.Type() != a.Type() {
+		return nil
+	}
+	switch indirect(e).Kind() {
+	case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array:
+		lines := make([]string, 0)
+		diffValues("", e, a, 0, &lines)
+		return lines
+	}
+	return nil
+}
+
+const maxDiffDepth = 10
+
+func indirect(v reflect.Value) reflect.Value {
+	for (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && !v.IsNil() {
+		v = v.Elem()
+	}
+	return v
+}
+
+func diffValues(path string, e, a reflect.Value, depth int, lines *[]string) {
+	mismatch := func() {
+		*lines = append(*lines, fmt.Sprintf("%s: expected %#v, got %#v", pathOrValue(path), e, a))
+	}
+	if depth > maxDiffDepth {
+		return
+	}
+	e, a = indirect(e), indirect(a)
+	if !e.IsValid() || !a.IsValid() || e.Type() != a.Type() {
+		if e.IsValid() != a.IsValid() || fmt.Sprintf("%#v", e) != fmt.Sprintf("%#v", a) {
+			mismatch()
+		}
+		return
+	}
+
+	switch e.Kind() {
+	case reflect.Struct:
+		for i := 0; i < e.NumField(); i++ {
+			diffValues(path+"."+e.Type().Field(i).Name, e.Field(i), a.Field(i), depth+1, lines)
+		}
+	case reflect.Slice, reflect.Array:
+		if e.Kind() == reflect.Slice && e.IsNil() != a.IsNil() {
+			mismatch()
+			return
+		}
+		if e.Len() != a.Len() {
+			*lines = append(*lines, fmt.Sprintf("%s: expected length %d, got %d", pathOrValue(path), e.Len(), a.Len()))
+		}
+		for i := 0; i < e.Len() && i < a.Len(); i++ {
+			diffValues(fmt.Sprintf("%s[%d]", path, i), e.Index(i), a.Index(i), depth+1, lines)
+		}
+	case reflect.Map:
+		if e.IsNil() != a.IsNil() {
+			mismatch()
+			return
+		}
+		keys := e.MapKeys()
+		for _, key := range a.MapKeys() {
+			if !e.MapIndex(key).IsValid() {
+				keys = append(keys, key)
+			}
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprintf("%#v", keys[i]) < fmt.Sprintf("%#v", keys[j])
+		})
+		for _, key := range keys {
+			keyPath := fmt.Sprintf("%s[%#v]", path, key)
+			ev, av := e.MapIndex(key), a.MapIndex(key)
+			switch {
+			case !av.IsValid():
+				*lines = append(*lines, fmt.Sprintf("%s: missing, expected %#v", keyPath, ev))
+			case !ev.IsValid():
+				*lines = append(*lines, fmt.Sprintf("%s: unexpected %#v", keyPath, av))
+			default:
+				diffValues(keyPath, ev, av, depth+1, lines)
+			}
+		}
+	default:
+		if fmt.Sprintf("%#v", e) != fmt.Sprintf("%#v", a) {
+			mismatch()
+		}
+	}
+}
+
+func pathOrValue(path string) string {
+	if path == "" {
+		return "value"
+	}
+	return path
+}
@@ -7,15 +7,27 @@ import (
 	"go/build"
 	"go/parser"
 	"go/printer"
+	"go/scanner"
 	"go/token"
 	"io"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
+// Returns the package with the given import path, the package is resolved
+// using the go.mod of the current directory in module mode
 func GetPackage(packageName string) (*build.Package, error) {
-	return build.Default.Import(packageName, ".", 0)
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	return build.Default.Import(packageName, cwd, 0)
 }
 
 func makeIdent(name string) *ast.Ident {
@@ -24,45 +36,118 @@ func makeIdent(name string) *ast.Ident {
 
 const Mock4goImport = "github.com/jvshahid/mock4go"
 
-func AddMock4goImport(f *ast.File) {
-	importSpec := &ast.ImportSpec{
-		Name: makeIdent("mock4go"),
-		Path: &ast.BasicLit{
-			Kind:  token.STRING,
-			Value: fmt.Sprintf("%#v", Mock4goImport),
+// Returns the function or the method expression passed to
+// FunctionCalled, generic functions are instantiated with their own type
+// parameters, e.g. Map[K, V], and the receiver of methods on generic types
+// already lists them, e.g. (*List[T]).Push
+func functionName(f *ast.FuncDecl) ast.Expr {
+	if f.Recv == nil {
+		return instantiate(makeIdent(f.Name.Name), typeParamNames(f.Type.TypeParams))
+	}
+	return &ast.SelectorExpr{
+		X: &ast.ParenExpr{
+			X: f.Recv.List[0].Type,
 		},
+		Sel: makeIdent(f.Name.Name),
 	}
+}
 
-	importDecl := &ast.GenDecl{
-		Tok: token.IMPORT, Specs: []ast.Spec{importSpec},
+// Returns x instantiated with the given type arguments or x if there are
+// none
+func instantiate(x ast.Expr, typeArgs []ast.Expr) ast.Expr {
+	switch len(typeArgs) {
+	case 0:
+		return x
+	case 1:
+		return &ast.IndexExpr{X: x, Index: typeArgs[0]}
 	}
+	return &ast.IndexListExpr{X: x, Indices: typeArgs}
+}
 
-	f.Decls = append([]ast.Decl{importDecl}, f.Decls...)
+func typeParamNames(typeParams *ast.FieldList) []ast.Expr {
+	names := make([]ast.Expr, 0)
+	if typeParams == nil {
+		return names
+	}
+	for _, param := range typeParams.List {
+		for _, name := range param.Names {
+			names = append(names, makeIdent(name.Name))
+		}
+	}
+	return names
 }
 
-func functionName(f *ast.FuncDecl) ast.Expr {
-	if f.Recv == nil {
-		return makeIdent(f.Name.Name)
+// give a name to the blank type parameters so the function can be
+// instantiated, e.g. func (l *List[_]) Len() becomes
+// func (l *List[T0]) Len()
+func nameTypeParams(f *ast.FuncDecl, names namer) {
+	if f.Type.TypeParams != nil {
+		i := 0
+		for _, param := range f.Type.TypeParams.List {
+			for _, name := range param.Names {
+				if name.Name == "_" {
+					name.Name = names.fresh(fmt.Sprintf("T%d", i))
+				}
+				i++
+			}
+		}
 	}
-	return &ast.BinaryExpr{
-		X: &ast.ParenExpr{
-			X: f.Recv.List[0].Type,
-		},
-		Op: token.PERIOD,
-		Y:  makeIdent(f.Name.Name),
+	if f.Recv == nil || len(f.Recv.List) == 0 {
+		return
+	}
+	recvType := f.Recv.List[0].Type
+	if star, ok := recvType.(*ast.StarExpr); ok {
+		recvType = star.X
+	}
+	var typeArgs []ast.Expr
+	switch x := recvType.(type) {
+	case *ast.IndexExpr:
+		typeArgs = []ast.Expr{x.Index}
+	case *ast.IndexListExpr:
+		typeArgs = x.Indices
+	}
+	for idx, typeArg := range typeArgs {
+		if ident, ok := typeArg.(*ast.Ident); ok && ident.Name == "_" {
+			ident.Name = names.fresh(fmt.Sprintf("T%d", idx))
+		}
 	}
 }
 
+// the identifiers used by a function or a file, used to pick names for
+// the generated identifiers that don't shadow or clash with them
+type namer map[string]bool
+
+func newNamer(node ast.Node) namer {
+	n := make(namer)
+	ast.Inspect(node, func(node ast.Node) bool {
+		if ident, ok := node.(*ast.Ident); ok {
+			n[ident.Name] = true
+		}
+		return true
+	})
+	return n
+}
+
+// Returns name, or name_N if name is already used, and reserves it
+func (n namer) fresh(name string) string {
+	candidate := name
+	for i := 1; n[candidate]; i++ {
+		candidate = fmt.Sprintf("%s_%d", name, i)
+	}
+	n[candidate] = true
+	return candidate
+}
+
 // construct the return statement that converts the interface{} type
 // returned from mock4go.FunctionCalled to the expected returned type
-func functionReturnExprs(f *ast.FuncDecl, stmts []ast.Stmt) []ast.Stmt {
+func functionReturnExprs(f *ast.FuncDecl, values string, temps []ast.Expr, stmts []ast.Stmt) []ast.Stmt {
 	if f.Type.Results == nil {
 		return nil
 	}
 
-	for idx, variable := range f.Type.Results.List {
+	for idx, resultType := range resultTypes(f.Type) {
 		value := &ast.IndexExpr{
-			X:     makeIdent("values"),
+			X:     makeIdent(values),
 			Index: makeIdent(strconv.Itoa(idx)),
 		}
 		stmts = append(stmts, &ast.IfStmt{
@@ -74,12 +159,12 @@ func functionReturnExprs(f *ast.FuncDecl, stmts []ast.Stmt) []ast.Stmt {
 			Body: &ast.BlockStmt{
 				List: []ast.Stmt{
 					&ast.AssignStmt{
-						Lhs: []ast.Expr{makeIdent(fmt.Sprintf("_temp%d", idx))},
+						Lhs: []ast.Expr{temps[idx]},
 						Tok: token.ASSIGN,
 						Rhs: []ast.Expr{
 							&ast.TypeAssertExpr{
 								X:    value,
-								Type: variable.Type,
+								Type: resultType,
 							},
 						},
 					},
@@ -94,32 +179,63 @@ func functionReturnExprs(f *ast.FuncDecl, stmts []ast.Stmt) []ast.Stmt {
 //    if value, ok, err := mock4go.FunctionCalled(myFunctionName, args); ok && err != nil {
 //      return value[0].(Type1), value[1].(Type2)
 //    }
-// at the beginning of the given function declaration.
-func instrumentFunction(f *ast.FuncDecl) bool {
-	if f.Name.Name == "init" {
+// at the beginning of the given function declaration. mock4go is the name
+// the file uses to import mock4go
+func instrumentFunction(f *ast.FuncDecl, mock4go string) bool {
+	// functions without a body are implemented in assembly or pulled in
+	// with //go:linkname
+	if f.Name.Name == "init" || f.Body == nil {
 		return false
 	}
 
-	variableDeclaration, returnVariables := declareReturnValuesVariables(f.Type)
+	// the parameters are in scope in the whole body, the variables of the
+	// generated if statement only have to avoid the names in the signature
+	names := newNamer(f)
+	nameTypeParams(f, names)
+	if f.Recv != nil && len(f.Recv.List) > 0 {
+		recv := f.Recv.List[0]
+		if len(recv.Names) == 0 {
+			// unnamed receiver, e.g. func (Foo) Bar()
+			recv.Names = []*ast.Ident{makeIdent(names.fresh("recv"))}
+		} else if recv.Names[0].Name == "_" {
+			recv.Names[0].Name = names.fresh("recv")
+		}
+	}
+	nameParameters(f.Type.Params, names)
+	restore := unshadowParameters(f, names)
+	names = newNamer(&ast.FuncDecl{Recv: f.Recv, Name: f.Name, Type: f.Type})
 
-	returnStmts := functionReturnExprs(f, variableDeclaration)
+	variableDeclaration, returnVariables := declareReturnValuesVariables(f.Type, names)
+
+	values := names.fresh("values")
+	returnStmts := functionReturnExprs(f, values, returnVariables, variableDeclaration)
 	returnStmts = append(returnStmts, &ast.ReturnStmt{
 		Results: returnVariables,
 	})
 	returnValues := "_"
 	if len(returnStmts) > 1 {
-		returnValues = "values"
+		returnValues = values
 	}
+	ok := names.fresh("ok")
+	err := names.fresh("err")
 
 	functionCalledArgs := []ast.Expr{
 		functionName(f),
 	}
 
+	functionCalled := mock4go + ".FunctionCalled"
 	if f.Recv != nil && len(f.Recv.List) > 0 {
+		functionCalled = mock4go + ".MethodCalled"
 		functionCalledArgs = append(functionCalledArgs, f.Recv.List[0].Names[0])
 	}
 
 	for _, arg := range f.Type.Params.List {
+		if _, ok := arg.Type.(*ast.Ellipsis); ok {
+			// the variadic arguments are passed as a single slice,
+			// mock4go expands them when matching the call
+			functionCalledArgs = append(functionCalledArgs, arg.Names[0])
+			continue
+		}
 		for _, name := range arg.Names {
 			functionCalledArgs = append(functionCalledArgs, name)
 		}
@@ -128,22 +244,22 @@ func instrumentFunction(f *ast.FuncDecl) bool {
 	initStmt := &ast.AssignStmt{
 		Lhs: []ast.Expr{
 			makeIdent(returnValues),
-			makeIdent("ok"),
-			makeIdent("err"),
+			makeIdent(ok),
+			makeIdent(err),
 		},
 		Tok: token.DEFINE,
 		Rhs: []ast.Expr{
 			&ast.CallExpr{
-				Fun:  makeIdent("mock4go.FunctionCalled"),
+				Fun:  makeIdent(functionCalled),
 				Args: functionCalledArgs,
 			},
 		},
 	}
 	condStmt := &ast.BinaryExpr{
-		X:  makeIdent("ok"),
+		X:  makeIdent(ok),
 		Op: token.LAND,
 		Y: &ast.BinaryExpr{
-			X:  makeIdent("err"),
+			X:  makeIdent(err),
 			Op: token.EQL,
 			Y:  makeIdent("nil"),
 		},
@@ -157,12 +273,85 @@ func instrumentFunction(f *ast.FuncDecl) bool {
 		Body: bodyStmt,
 	}
 	body := f.Body
-	stmts := body.List
-	stmts = append([]ast.Stmt{stmt}, stmts...)
-	body.List = stmts
+	stmts := append([]ast.Stmt{stmt}, restore...)
+	body.List = append(stmts, body.List...)
 	return true
 }
 
+// Rename the receiver and the parameters named after an identifier used
+// in the types of the signature, the generated code refers to the types
+// and the parameter would shadow them, e.g. url in
+//
+//	func Parse(url string) (*url.URL, error)
+//
+// Returns the statements that declare the original names after the
+// generated code, e.g. url := url_1
+func unshadowParameters(f *ast.FuncDecl, names namer) []ast.Stmt {
+	used := make(map[string]bool)
+	for _, fields := range []*ast.FieldList{f.Recv, f.Type.Params, f.Type.Results} {
+		if fields == nil {
+			continue
+		}
+		for _, field := range fields.List {
+			ast.Inspect(field.Type, func(node ast.Node) bool {
+				if ident, ok := node.(*ast.Ident); ok {
+					used[ident.Name] = true
+				}
+				return true
+			})
+		}
+	}
+	stmts := make([]ast.Stmt, 0)
+	for _, fields := range []*ast.FieldList{f.Recv, f.Type.Params} {
+		if fields == nil {
+			continue
+		}
+		for _, field := range fields.List {
+			for _, name := range field.Names {
+				if !used[name.Name] {
+					continue
+				}
+				original := name.Name
+				name.Name = names.fresh(original)
+				stmts = append(stmts,
+					&ast.AssignStmt{
+						Lhs: []ast.Expr{makeIdent(original)},
+						Tok: token.DEFINE,
+						Rhs: []ast.Expr{makeIdent(name.Name)},
+					},
+					// the body may not use it
+					&ast.AssignStmt{
+						Lhs: []ast.Expr{makeIdent("_")},
+						Tok: token.ASSIGN,
+						Rhs: []ast.Expr{makeIdent(original)},
+					},
+				)
+			}
+		}
+	}
+	return stmts
+}
+
+// give a name to the unnamed and blank parameters so they can be passed
+// to FunctionCalled, e.g. func(string, _ int) becomes
+// func(arg0 string, arg1 int)
+func nameParameters(params *ast.FieldList, names namer) {
+	i := 0
+	for _, param := range params.List {
+		if len(param.Names) == 0 {
+			param.Names = []*ast.Ident{makeIdent(names.fresh(fmt.Sprintf("arg%d", i)))}
+			i++
+			continue
+		}
+		for _, name := range param.Names {
+			if name.Name == "_" {
+				name.Name = names.fresh(fmt.Sprintf("arg%d", i))
+			}
+			i++
+		}
+	}
+}
+
 type Interface struct {
 	pkg           string
 	name          string
@@ -172,77 +361,103 @@ type Interface struct {
 
 var interfaces = make(map[string]Interface) // map from pkg.InterfaceName to the Interface type
 
-func declareReturnValuesVariables(funType *ast.FuncType) ([]ast.Stmt, []ast.Expr) {
+func declareReturnValuesVariables(funType *ast.FuncType, names namer) ([]ast.Stmt, []ast.Expr) {
 	stmts := make([]ast.Stmt, 0)
 	returnVariables := make([]ast.Expr, 0)
 
-	if funType.Results != nil {
-		for idx, returnValue := range funType.Results.List {
-			// add a declaration
-			name := fmt.Sprintf("_temp%d", idx)
-			returnVariables = append(returnVariables, makeIdent(name))
-			stmts = append(stmts, &ast.DeclStmt{
-				Decl: &ast.GenDecl{
-					Tok: token.VAR,
-					Specs: []ast.Spec{
-						&ast.ValueSpec{
-							Type:  returnValue.Type,
-							Names: []*ast.Ident{makeIdent(name)},
-						},
+	for idx, resultType := range resultTypes(funType) {
+		// add a declaration
+		name := names.fresh(fmt.Sprintf("_temp%d", idx))
+		returnVariables = append(returnVariables, makeIdent(name))
+		stmts = append(stmts, &ast.DeclStmt{
+			Decl: &ast.GenDecl{
+				Tok: token.VAR,
+				Specs: []ast.Spec{
+					&ast.ValueSpec{
+						Type:  resultType,
+						Names: []*ast.Ident{makeIdent(name)},
 					},
 				},
-			})
-		}
+			},
+		})
 	}
 
 	return stmts, returnVariables
 }
 
-func instrumentInterfaceFunction(interfaceName string,
-	intrface *ast.InterfaceType, funName *ast.Ident, funType *ast.FuncType) ast.Decl {
-	// add a general declaration one per return value to guarantee
-	// they are assigned the zero value, then return those variables
-	stmts, returnVariables := declareReturnValuesVariables(funType)
+// Returns the type of each result, a field declares more than one result
+// if the results are grouped, e.g. func() (a, b int)
+func resultTypes(funType *ast.FuncType) []ast.Expr {
+	types := make([]ast.Expr, 0)
+	if funType.Results == nil {
+		return types
+	}
+	for _, result := range funType.Results.List {
+		count := len(result.Names)
+		if count == 0 {
+			count = 1
+		}
+		for i := 0; i < count; i++ {
+			types = append(types, result.Type)
+		}
+	}
+	return types
+}
+
+func instrumentInterfaceFunction(interfaceName string, typeParams *ast.FieldList,
+	intrface *ast.InterfaceType, funName *ast.Ident, funType *ast.FuncType, mock4go string) ast.Decl {
+	names := newNamer(funType)
+	names[mock4go] = true
+	for _, name := range typeParamNames(typeParams) {
+		names[name.(*ast.Ident).Name] = true
+	}
 
 	// set a name to each function argument
 	if funType.Params != nil {
 		var i = 0
 		for _, arg := range funType.Params.List {
-			names := make([]*ast.Ident, 0)
-			for _, _ = range arg.Names {
-				names = append(names, makeIdent(fmt.Sprintf("arg%d", i)))
+			count := len(arg.Names)
+			if count == 0 {
+				// unnamed parameter, e.g. Value(string) string
+				count = 1
+			}
+			argNames := make([]*ast.Ident, 0, count)
+			for j := 0; j < count; j++ {
+				argNames = append(argNames, makeIdent(names.fresh(fmt.Sprintf("arg%d", i))))
 				i++
 			}
-			arg.Names = names
+			arg.Names = argNames
 		}
 	}
 
-	stmts = append(stmts, &ast.ReturnStmt{
-		Results: returnVariables,
-	})
-
 	newDecl := &ast.FuncDecl{
 		Name: funName,
 		Recv: &ast.FieldList{
 			List: []*ast.Field{
 				&ast.Field{
-					Names: []*ast.Ident{makeIdent("recv")},
+					Names: []*ast.Ident{makeIdent(names.fresh("recv"))},
 					Type: &ast.StarExpr{
-						X: makeIdent("Mock" + interfaceName),
+						X: instantiate(makeIdent("Mock"+interfaceName), typeParamNames(typeParams)),
 					},
 				},
 			},
 		},
 		Type: funType,
-		Body: &ast.BlockStmt{
-			List: stmts,
-		},
+		Body: &ast.BlockStmt{},
 	}
-	instrumentFunction(newDecl)
+	instrumentFunction(newDecl, mock4go)
+
+	// add a general declaration one per return value to guarantee
+	// they are assigned the zero value, then return those variables
+	stmts, returnVariables := declareReturnValuesVariables(funType, names)
+	stmts = append(stmts, &ast.ReturnStmt{
+		Results: returnVariables,
+	})
+	newDecl.Body.List = append(newDecl.Body.List, stmts...)
 	return newDecl
 }
 
-func instrumentInterface(name string, intrface *ast.InterfaceType) []ast.Decl {
+func instrumentInterface(name string, typeParams *ast.FieldList, intrface *ast.InterfaceType, mock4go string) []ast.Decl {
 	declarations := make([]ast.Decl, 0)
 
 	structFunctions := make([]*ast.Field, 0)
@@ -257,6 +472,19 @@ func instrumentInterface(name string, intrface *ast.InterfaceType) []ast.Decl {
 			structEmbedded = append(structEmbedded, &ast.Field{
 				Type: makeIdent("Mock" + x.Name),
 			})
+		case *ast.IndexExpr:
+			// embedded generic interface, e.g. Store[K, string]
+			if ident, ok := x.X.(*ast.Ident); ok {
+				structEmbedded = append(structEmbedded, &ast.Field{
+					Type: instantiate(makeIdent("Mock"+ident.Name), []ast.Expr{x.Index}),
+				})
+			}
+		case *ast.IndexListExpr:
+			if ident, ok := x.X.(*ast.Ident); ok {
+				structEmbedded = append(structEmbedded, &ast.Field{
+					Type: instantiate(makeIdent("Mock"+ident.Name), x.Indices),
+				})
+			}
 		}
 	}
 
@@ -265,7 +493,8 @@ func instrumentInterface(name string, intrface *ast.InterfaceType) []ast.Decl {
 			Tok: token.TYPE,
 			Specs: []ast.Spec{
 				&ast.TypeSpec{
-					Name: makeIdent("Mock" + name),
+					Name:       makeIdent("Mock" + name),
+					TypeParams: typeParams,
 					Type: &ast.StructType{
 						Fields: &ast.FieldList{
 							List: structEmbedded,
@@ -277,19 +506,24 @@ func instrumentInterface(name string, intrface *ast.InterfaceType) []ast.Decl {
 	)
 
 	for _, fun := range structFunctions {
-		decl := instrumentInterfaceFunction(name, intrface, fun.Names[0], fun.Type.(*ast.FuncType))
+		decl := instrumentInterfaceFunction(name, typeParams, intrface, fun.Names[0], fun.Type.(*ast.FuncType), mock4go)
 		declarations = append(declarations, decl)
 	}
 	return declarations
 }
 
-func InstrumentFunctionsAndInterfaces(f *ast.File) bool {
+// Instrument the functions and generate the mocks of the interfaces
+// declared in the file. mock4go is the name the file uses to import
+// mock4go and types are the identifiers declared in the package, a mock
+// isn't generated if its name is already declared or if the interface can
+// only be used as a type constraint
+func InstrumentFunctionsAndInterfaces(f *ast.File, mock4go string, types *packageTypes) bool {
 	addMock4goImport := false
 
 	ast.Inspect(f, func(n ast.Node) bool {
 		switch x := n.(type) {
 		case *ast.FuncDecl:
-			if instrumentFunction(x) {
+			if instrumentFunction(x, mock4go) {
 				addMock4goImport = true
 			}
 			if x.Recv != nil {
@@ -307,7 +541,15 @@ func InstrumentFunctionsAndInterfaces(f *ast.File) bool {
 						// TODO: what should we do here
 						panic("incomplete interface type")
 					}
-					decls := instrumentInterface(typeSpec.Name.Name, interfaceType)
+					if types.constraints[typeSpec.Name.Name] {
+						return true
+					}
+					if mockName := "Mock" + typeSpec.Name.Name; types.declared[mockName] {
+						Log("not generating %s for interface %s, %s is already declared in package %s\n",
+							mockName, typeSpec.Name.Name, mockName, f.Name.Name)
+						return true
+					}
+					decls := instrumentInterface(typeSpec.Name.Name, typeSpec.TypeParams, interfaceType, mock4go)
 					addMock4goImport = true
 					f.Decls = append(f.Decls, decls...)
 				}
@@ -320,25 +562,299 @@ func InstrumentFunctionsAndInterfaces(f *ast.File) bool {
 }
 
 func InstrumentFile(fileName string) (string, error) {
+	types, err := scanTypes([]string{fileName})
+	if err != nil {
+		return "", err
+	}
+	return instrumentFile(fileName, types)
+}
+
+// the top level identifiers declared in a package
+type packageTypes struct {
+	declared    map[string]bool // the types, functions, variables and constants
+	constraints map[string]bool // the interfaces that can only be used as type constraints
+}
+
+func scanTypes(fileNames []string) (*packageTypes, error) {
+	types := &packageTypes{
+		declared:    make(map[string]bool),
+		constraints: make(map[string]bool),
+	}
+	interfaces := make(map[string]*ast.InterfaceType)
+	fset := token.NewFileSet()
+	for _, fileName := range fileNames {
+		f, err := parser.ParseFile(fset, fileName, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, decl := range f.Decls {
+			switch x := decl.(type) {
+			case *ast.FuncDecl:
+				if x.Recv == nil {
+					types.declared[x.Name.Name] = true
+				}
+			case *ast.GenDecl:
+				for _, spec := range x.Specs {
+					switch spec := spec.(type) {
+					case *ast.TypeSpec:
+						types.declared[spec.Name.Name] = true
+						if interfaceType, ok := spec.Type.(*ast.InterfaceType); ok {
+							interfaces[spec.Name.Name] = interfaceType
+						}
+					case *ast.ValueSpec:
+						for _, name := range spec.Names {
+							types.declared[name.Name] = true
+						}
+					}
+				}
+			}
+		}
+	}
+	for name := range interfaces {
+		if isConstraint(name, interfaces, make(map[string]bool)) {
+			types.constraints[name] = true
+		}
+	}
+	return types, nil
+}
+
+// Returns true if the interface has union or ~T elements, embeds a type
+// that isn't an interface or embeds another constraint, e.g.
+//
+//	type Number interface {
+//		~int | ~float64
+//	}
+func isConstraint(name string, interfaces map[string]*ast.InterfaceType, seen map[string]bool) bool {
+	if seen[name] {
+		return false
+	}
+	seen[name] = true
+	for _, element := range interfaces[name].Methods.List {
+		switch x := element.Type.(type) {
+		case *ast.FuncType:
+		case *ast.Ident:
+			if _, ok := interfaces[x.Name]; ok {
+				if isConstraint(x.Name, interfaces, seen) {
+					return true
+				}
+			} else if x.Name != "error" {
+				// comparable or a type that isn't an interface
+				return true
+			}
+		case *ast.IndexExpr, *ast.IndexListExpr, *ast.SelectorExpr:
+			// embedded generic interface or an interface from
+			// another package
+		default:
+			// union or ~T
+			return true
+		}
+	}
+	return false
+}
+
+// Instrument the file by inserting the generated code in the original
+// source instead of printing the modified AST, this way the comments,
+// e.g. the build constraints, the compiler directives and the cgo
+// preamble, are kept as is and the original code stays on the same lines.
+// The stubs are inserted on the line of the opening brace of the
+// functions, the import on the line of the package clause and the mocks
+// are appended to the file. A //line directive maps the instrumented file
+// back to fileName so the stack traces and the test failures point to the
+// original source, the mocks are attributed to <file>_mock4go.go
+func instrumentFile(fileName string, types *packageTypes) (string, error) {
 	Log("instrumenting file %s\n", fileName)
+	src, err := os.ReadFile(fileName)
+	if err != nil {
+		return "", err
+	}
 	// Create the AST by parsing src.
 	fset := token.NewFileSet() // positions are relative to fset
-	f, err := parser.ParseFile(fset, fileName, nil, 0)
+	f, err := parser.ParseFile(fset, fileName, src, parser.ParseComments)
 	if err != nil {
 		return "", err
 	}
-	if InstrumentFunctionsAndInterfaces(f) {
-		AddMock4goImport(f)
+	declared := len(f.Decls)
+	// the import must not be shadowed by any identifier in the file nor
+	// conflict with the identifiers declared in the other files of the
+	// package
+	names := newNamer(f)
+	for name := range types.declared {
+		names[name] = true
 	}
-	f.Comments = nil
-	buf := bytes.NewBufferString("")
-	err = printer.Fprint(buf, fset, f)
-	if err != nil {
-		return "", err
+	mock4go := names.fresh("mock4go")
+	if !InstrumentFunctionsAndInterfaces(f, mock4go, types) {
+		return lineDirective(fileName) + string(src), nil
+	}
+
+	file := fset.File(f.Pos())
+	edits := []edit{{
+		offset: file.Offset(f.Name.End()),
+		text:   fmt.Sprintf("; import %s %#v", mock4go, Mock4goImport),
+	}}
+	for _, decl := range f.Decls[:declared] {
+		if fun, ok := decl.(*ast.FuncDecl); ok {
+			funEdits, err := functionEdits(fset, src, fun)
+			if err != nil {
+				return "", err
+			}
+			edits = append(edits, funEdits...)
+		}
+	}
+	sort.SliceStable(edits, func(i, j int) bool {
+		return edits[i].offset < edits[j].offset
+	})
+
+	buf := bytes.NewBufferString(lineDirective(fileName))
+	last := 0
+	for _, e := range edits {
+		buf.Write(src[last:e.offset])
+		buf.WriteString(e.text)
+		last = e.offset + e.length
+	}
+	buf.Write(src[last:])
+	if !bytes.HasSuffix(src, []byte("\n")) {
+		buf.WriteString("\n")
+	}
+	if len(f.Decls) > declared {
+		buf.WriteString("\n" + lineDirective(strings.TrimSuffix(fileName, ".go")+"_mock4go.go"))
+	}
+	for idx, decl := range f.Decls[declared:] {
+		if idx > 0 {
+			buf.WriteString("\n")
+		}
+		if err := printer.Fprint(buf, fset, decl); err != nil {
+			return "", err
+		}
+		buf.WriteString("\n")
 	}
 	return buf.String(), nil
 }
 
+// Returns the //line directive that maps the following lines to fileName,
+// starting at line 1
+func lineDirective(fileName string) string {
+	return fmt.Sprintf("//line %s:1\n", fileName)
+}
+
+// replace length bytes of the source at offset with text
+type edit struct {
+	offset int
+	length int
+	text   string
+}
+
+// Returns the edits that give a name to the unnamed and blank parameters
+// of the function and insert the stub generated by instrumentFunction
+func functionEdits(fset *token.FileSet, src []byte, fun *ast.FuncDecl) ([]edit, error) {
+	if fun.Body == nil || len(fun.Body.List) == 0 || fun.Body.List[0].Pos().IsValid() {
+		// the function wasn't instrumented
+		return nil, nil
+	}
+	file := fset.File(fun.Pos())
+	edits := make([]edit, 0)
+	signature := func(node ast.Node) bool {
+		switch x := node.(type) {
+		case *ast.Field:
+			if len(x.Names) > 0 && !x.Names[0].Pos().IsValid() {
+				names := make([]string, 0, len(x.Names))
+				for _, name := range x.Names {
+					names = append(names, name.Name)
+				}
+				edits = append(edits, edit{
+					offset: file.Offset(x.Type.Pos()),
+					text:   strings.Join(names, ", ") + " ",
+				})
+			}
+		case *ast.Ident:
+			if !x.Pos().IsValid() {
+				break
+			}
+			// the blank and shadowing parameters that were renamed
+			offset := file.Offset(x.Pos())
+			if original := identifierAt(src, offset); original != x.Name {
+				edits = append(edits, edit{offset: offset, length: len(original), text: x.Name})
+			}
+		}
+		return true
+	}
+	if fun.Recv != nil {
+		ast.Inspect(fun.Recv, signature)
+	}
+	ast.Inspect(fun.Type, signature)
+
+	// the generated statements are the ones without a position
+	text := ""
+	for _, stmt := range fun.Body.List {
+		if stmt.Pos().IsValid() {
+			break
+		}
+		buf := bytes.NewBufferString("")
+		if err := printer.Fprint(buf, fset, stmt); err != nil {
+			return nil, err
+		}
+		text += " " + singleLine(buf.Bytes()) + ";"
+	}
+	edits = append(edits, edit{
+		offset: file.Offset(fun.Body.Lbrace) + 1,
+		text:   text,
+	})
+	return edits, nil
+}
+
+// Returns the identifier that starts at offset in src
+func identifierAt(src []byte, offset int) string {
+	end := offset
+	for end < len(src) {
+		r, size := utf8.DecodeRune(src[end:])
+		if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			break
+		}
+		end += size
+	}
+	return string(src[offset:end])
+}
+
+// Returns the code on a single line, the newlines that end a statement
+// are replaced by semicolons
+func singleLine(code []byte) string {
+	fset := token.NewFileSet()
+	file := fset.AddFile("", -1, len(code))
+	var s scanner.Scanner
+	s.Init(file, code, nil, 0)
+	buf := bytes.NewBufferString("")
+	last := 0
+	newline := false
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		offset := file.Offset(pos)
+		if tok == token.SEMICOLON && lit == "\n" {
+			// automatically inserted semicolon, the code is followed by
+			// another statement anyway
+			if offset < len(code) {
+				buf.WriteString(";")
+			}
+			last = offset + 1
+			newline = true
+			continue
+		}
+		if space := string(code[last:offset]); newline || strings.Contains(space, "\n") {
+			buf.WriteString(" ")
+		} else {
+			buf.WriteString(space)
+		}
+		newline = false
+		if lit == "" {
+			lit = tok.String()
+		}
+		buf.WriteString(lit)
+		last = offset + len(lit)
+	}
+	return buf.String()
+}
+
 var instrumented = make(map[string]*build.Package)
 
 func InstrumentPackage(packageName string, tmpDir string) (*build.Package, error) {
@@ -382,10 +898,30 @@ func copyPackage(pkg *build.Package, tmpDir string) error {
 		return err
 	}
 
+	// the files embedded with //go:embed, copied first so a Go file that
+	// is embedded is copied like the other Go files
+	embedded, err := embedFiles(pkg)
+	if err != nil {
+		return err
+	}
+	for _, file := range embedded {
+		err := copyTree(filepath.Join(pkg.Dir, file), filepath.Join(dst, file))
+		if err != nil {
+			return err
+		}
+	}
+
+	// the Go files point to the original ones
+	for _, list := range [][]string{pkg.GoFiles, pkg.CgoFiles, pkg.TestGoFiles} {
+		for _, file := range list {
+			err := copyGoFile(path.Join(pkg.Dir, file), path.Join(dst, file))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
 	filesLists := [][]string{
-		pkg.GoFiles,
-		pkg.TestGoFiles,
-		pkg.CgoFiles,
 		pkg.CFiles,
 		pkg.HFiles,
 		pkg.SFiles,
@@ -403,15 +939,72 @@ func copyPackage(pkg *build.Package, tmpDir string) error {
 	return nil
 }
 
+// Returns the files and the directories matching the //go:embed patterns
+// of the package and its tests, relative to the package directory
+func embedFiles(pkg *build.Package) ([]string, error) {
+	files := make([]string, 0)
+	for _, list := range [][]string{pkg.EmbedPatterns, pkg.TestEmbedPatterns} {
+		for _, pattern := range list {
+			// all: only changes which files of a directory are embedded
+			pattern = strings.TrimPrefix(pattern, "all:")
+			matches, err := filepath.Glob(filepath.Join(pkg.Dir, filepath.FromSlash(pattern)))
+			if err != nil {
+				return nil, err
+			}
+			for _, match := range matches {
+				file, err := filepath.Rel(pkg.Dir, match)
+				if err != nil {
+					return nil, err
+				}
+				files = append(files, file)
+			}
+		}
+	}
+	return files, nil
+}
+
+// Copy the file or the directory src to dst
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, os.ModePerm)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+			return err
+		}
+		return copyFile(file, target)
+	})
+}
+
+// Copy the Go file src to dst with a //line directive that maps the copy
+// back to src, e.g. the test failures point to the original test files
+func copyGoFile(src, dst string) error {
+	content, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, append([]byte(lineDirective(src)), content...), 0644)
+}
+
 func copyFile(src, dst string) error {
 	srcFile, err := os.Open(src)
 	if err != nil {
 		return err
 	}
+	defer srcFile.Close()
 	dstFile, err := os.Create(dst)
 	if err != nil {
 		return err
 	}
+	defer dstFile.Close()
 	_, err = io.Copy(dstFile, srcFile)
 	return err
 }
@@ -427,26 +1020,66 @@ func InstrumentPackageRecur(pkg *build.Package, tmpDir string, instrumented map[
 	}
 
 	// copy only, don't instrument mock4go
-	if pkg.ImportPath == Mock4goImport || pkg.ImportPath == "launchpad.net/gocheck" {
+	if SkipInstrumentation(pkg.ImportPath) {
 		return
 	}
 
+	// instrument the original files so the //line directives point to them
+	_, err = instrumentPackageFiles(pkg.Dir, path.Join(tmpDir, pkg.ImportPath), pkg.GoFiles, pkg.CgoFiles, pkg.TestGoFiles)
+	return err
+}
+
+// Returns true for the packages that must not be instrumented, i.e.
+// mock4go itself and the test framework
+func SkipInstrumentation(importPath string) bool {
+	return importPath == Mock4goImport || strings.HasPrefix(importPath, Mock4goImport+"/") ||
+		importPath == "launchpad.net/gocheck"
+}
+
+// Instrument the given files of the package in srcDir and write them to
+// dstDir, which can be the same directory. The files that import "C" are
+// instrumented like the other Go files, the test files are only used to
+// find the identifiers declared in the package. Returns the instrumented
+// files by the path of the original file
+func instrumentPackageFiles(srcDir, dstDir string, goFiles, cgoFiles, testGoFiles []string) (map[string]string, error) {
+	files := make([]string, 0)
+	for _, list := range [][]string{goFiles, cgoFiles, testGoFiles} {
+		for _, file := range list {
+			files = append(files, path.Join(srcDir, file))
+		}
+	}
+	return InstrumentFiles(files, dstDir)
+}
+
+// Instrument the given files of a package and write them to dstDir. The
+// test files aren't instrumented, they are only used to find the types
+// declared in the package. Returns the instrumented files by the path of
+// the original file
+func InstrumentFiles(files []string, dstDir string) (map[string]string, error) {
+	// the test files can declare types too
+	types, err := scanTypes(files)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dstDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	instrumented := make(map[string]string)
 	// fmt.Printf("package %s contains: %s\n", pkg, strings.Join(files, ","))
-	for _, file := range pkg.GoFiles {
-		fileName := path.Join(tmpDir, pkg.ImportPath, file)
-		content, err := InstrumentFile(fileName)
-		if err != nil {
-			return err
+	for _, fileName := range files {
+		if strings.HasSuffix(fileName, "_test.go") {
+			continue
 		}
-		file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_TRUNC, os.ModePerm)
+		content, err := instrumentFile(fileName, types)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		_, err = file.Write([]byte(content))
-		if err != nil {
-			return err
+		dstName := path.Join(dstDir, path.Base(fileName))
+		if err := os.WriteFile(dstName, []byte(content), 0644); err != nil {
+			return nil, err
 		}
-		file.Close()
+		instrumented[fileName] = dstName
 	}
-	return nil
+	return instrumented, nil
 }
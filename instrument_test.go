@@ -1,10 +1,17 @@
 package api
 
 import (
+	"flag"
+	"go/build"
 	. "launchpad.net/gocheck"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
+var update = flag.Bool("update", false, "update the golden files")
+
 func Test(t *testing.T) {
 	TestingT(t)
 }
@@ -20,6 +27,63 @@ func (suite *Mock4goTestSuite) TearDownTest(c *C) {
 
 var _ = Suite(&Mock4goTestSuite{})
 
+// instrument each file in testdata/instrument and compare the output with
+// the .golden file next to it, run with -update to rewrite the golden files
 func (s *Mock4goTestSuite) TestInstrumentFile(c *C) {
-	c.Fail()
+	files, err := filepath.Glob("testdata/instrument/*.go")
+	c.Assert(err, IsNil)
+	c.Assert(files, Not(HasLen), 0)
+	for _, file := range files {
+		instrumented, err := InstrumentFile(file)
+		c.Assert(err, IsNil)
+		golden := strings.TrimSuffix(file, ".go") + ".golden"
+		if *update {
+			c.Assert(os.WriteFile(golden, []byte(instrumented), 0644), IsNil)
+			continue
+		}
+		expected, err := os.ReadFile(golden)
+		c.Assert(err, IsNil)
+		c.Assert(instrumented, Equals, string(expected), Commentf("instrumenting %s", file))
+	}
+}
+
+// instrument the files of each package in testdata/instrument together, the
+// identifiers declared in one file affect the code generated for the others
+func (s *Mock4goTestSuite) TestInstrumentPackageFiles(c *C) {
+	files, err := filepath.Glob("testdata/instrument/*/*.go")
+	c.Assert(err, IsNil)
+	c.Assert(files, Not(HasLen), 0)
+	packages := make(map[string][]string)
+	for _, file := range files {
+		packages[filepath.Dir(file)] = append(packages[filepath.Dir(file)], file)
+	}
+	for _, files := range packages {
+		types, err := scanTypes(files)
+		c.Assert(err, IsNil)
+		for _, file := range files {
+			instrumented, err := instrumentFile(file, types)
+			c.Assert(err, IsNil)
+			golden := strings.TrimSuffix(file, ".go") + ".golden"
+			if *update {
+				c.Assert(os.WriteFile(golden, []byte(instrumented), 0644), IsNil)
+				continue
+			}
+			expected, err := os.ReadFile(golden)
+			c.Assert(err, IsNil)
+			c.Assert(instrumented, Equals, string(expected), Commentf("instrumenting %s", file))
+		}
+	}
+}
+
+// copy mode builds the copy of the package, it needs the files embedded
+// by the package and its tests
+func (s *Mock4goTestSuite) TestCopyingTheEmbeddedFiles(c *C) {
+	pkg, err := build.ImportDir("testdata/embed", 0)
+	c.Assert(err, IsNil)
+	dst := c.MkDir()
+	c.Assert(copyPackage(pkg, dst), IsNil)
+	for _, file := range []string{"greeting.txt", "static/index.html", "expected/greeting.txt"} {
+		_, err := os.Stat(filepath.Join(dst, pkg.ImportPath, file))
+		c.Assert(err, IsNil)
+	}
 }
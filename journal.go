@@ -0,0 +1,127 @@
+package api
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// Call is a call to an instrumented function that was made outside of
+// Mock and Verifying
+type Call struct {
+	Receiver     interface{}   // the receiver of the method or nil for functions
+	Args         []interface{} // the arguments excluding the receiver
+	Returned     []interface{} // the values returned by the stub, nil if no stub matched
+	Matched      bool          // true if a stub matched the call
+	Stub         *functionCall // the stub that matched the call
+	RealReturned []interface{} // the values returned by the real implementation if it was called by the stub
+	Panicked     bool          // true if the stub or the real implementation panicked
+	Panic        interface{}   // the value the call panicked with
+
+	funType     interface{}
+	fun         function
+	hasReceiver bool
+}
+
+func newCall(funType interface{}, fun function, hasReceiver bool, args []interface{}) *Call {
+	call := &Call{
+		Args:        args,
+		funType:     funType,
+		fun:         fun,
+		hasReceiver: hasReceiver,
+	}
+	if hasReceiver {
+		call.Receiver = args[0]
+		call.Args = args[1:]
+	}
+	return call
+}
+
+// the arguments including the receiver, i.e. what the stubs match against
+func (c *Call) arguments() []interface{} {
+	if c.hasReceiver {
+		return append([]interface{}{c.Receiver}, c.Args...)
+	}
+	return c.Args
+}
+
+// the arguments the given matchers are applied to
+func (c *Call) matchedArguments(matchers []Matcher) []interface{} {
+	return expandArgs(c.fun, matchers, c.arguments())
+}
+
+func (c *Call) String() string {
+	return fmt.Sprintf("%s(%s)", funcName(c.fun), formatArgs(c.arguments()))
+}
+
+// Returns all the calls made to the given function in the order they
+// were made. Use a method expression for methods, e.g.
+// Calls((*Foo).Bar)
+func Calls(fun function) []*Call {
+	return global.calls(fun)
+}
+
+// Returns the last call made to the given function or nil if the
+// function wasn't called
+func LastCall(fun function) *Call {
+	return global.lastCall(fun)
+}
+
+func (r *registry) calls(fun function) []*Call {
+	lock.Lock()
+	defer lock.Unlock()
+	funType := getFunType(fun)
+	calls := make([]*Call, 0)
+	for _, call := range r.journal {
+		if call.funType == funType {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// remove the calls made after the given call, or all the calls if it
+// isn't in the journal anymore, must be called while holding the lock
+func (r *registry) removeCallsAfter(last *Call) {
+	for idx := len(r.journal) - 1; idx >= 0; idx-- {
+		if r.journal[idx] == last {
+			r.journal = r.journal[:idx+1]
+			return
+		}
+	}
+	r.journal = make([]*Call, 0)
+}
+
+func (r *registry) lastCall(fun function) *Call {
+	calls := r.calls(fun)
+	if len(calls) == 0 {
+		return nil
+	}
+	return calls[len(calls)-1]
+}
+
+// matches the suffix of the closure created by referring to a generic
+// function inside its body, e.g. test.Map[...].func1
+var closureSuffix = regexp.MustCompile(`\.func\d+$`)
+
+func funcName(fun function) string {
+	f := runtime.FuncForPC(reflect.ValueOf(fun).Pointer())
+	if f == nil {
+		return fmt.Sprintf("%#v", fun)
+	}
+	name := f.Name()
+	if strings.Contains(name, "[...]") {
+		name = closureSuffix.ReplaceAllString(name, "")
+	}
+	return name
+}
+
+func formatArgs(args []interface{}) string {
+	formatted := make([]string, 0, len(args))
+	for _, arg := range args {
+		formatted = append(formatted, fmt.Sprintf("%#v", arg))
+	}
+	return strings.Join(formatted, ", ")
+}
@@ -0,0 +1,283 @@
+// Package matchers provides argument matchers that can be used with
+// WithMatchers, e.g.
+//
+//	When(Foo("", 0)).WithMatchers(matchers.Prefix("ba"), matchers.Gt(10)).Return("bar")
+package matchers
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// Matcher is the same as mock4go.Matcher, it's declared here to avoid the
+// import cycle with the instrumented packages
+type Matcher interface {
+	Matches(interface{}) bool
+}
+
+type funcMatcher struct {
+	name    string
+	matches func(interface{}) bool
+}
+
+func (m *funcMatcher) Matches(actual interface{}) bool {
+	return m.matches(actual)
+}
+
+// Describe is used by mock4go to describe the matcher in failure messages
+func (m *funcMatcher) Describe() string {
+	return m.name
+}
+
+func (m *funcMatcher) String() string {
+	return m.name
+}
+
+func describe(matchers []Matcher) string {
+	descriptions := make([]string, 0, len(matchers))
+	for _, m := range matchers {
+		if stringer, ok := m.(fmt.Stringer); ok {
+			descriptions = append(descriptions, stringer.String())
+		} else {
+			descriptions = append(descriptions, fmt.Sprintf("%#v", m))
+		}
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+func newMatcher(name string, matches func(interface{}) bool) Matcher {
+	return &funcMatcher{name: name, matches: matches}
+}
+
+// Any matches any value
+func Any() Matcher {
+	return newMatcher("Any()", func(interface{}) bool {
+		return true
+	})
+}
+
+// Eq matches values that are equal to the expected value using reflect.DeepEqual
+func Eq(expected interface{}) Matcher {
+	return newMatcher(fmt.Sprintf("Eq(%#v)", expected), func(actual interface{}) bool {
+		return reflect.DeepEqual(expected, actual)
+	})
+}
+
+// Nil matches nil and nil pointers, slices, maps, channels, functions and interfaces
+func Nil() Matcher {
+	return newMatcher("Nil()", isNil)
+}
+
+func NotNil() Matcher {
+	return Not(Nil())
+}
+
+func isNil(actual interface{}) bool {
+	if actual == nil {
+		return true
+	}
+	v := reflect.ValueOf(actual)
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Chan, reflect.Func, reflect.Interface, reflect.UnsafePointer:
+		return v.IsNil()
+	}
+	return false
+}
+
+func stringMatcher(name string, matches func(string) bool) Matcher {
+	return newMatcher(name, func(actual interface{}) bool {
+		s, ok := actual.(string)
+		return ok && matches(s)
+	})
+}
+
+func Prefix(prefix string) Matcher {
+	return stringMatcher(fmt.Sprintf("Prefix(%q)", prefix), func(s string) bool {
+		return strings.HasPrefix(s, prefix)
+	})
+}
+
+func Suffix(suffix string) Matcher {
+	return stringMatcher(fmt.Sprintf("Suffix(%q)", suffix), func(s string) bool {
+		return strings.HasSuffix(s, suffix)
+	})
+}
+
+func Contains(substr string) Matcher {
+	return stringMatcher(fmt.Sprintf("Contains(%q)", substr), func(s string) bool {
+		return strings.Contains(s, substr)
+	})
+}
+
+// Regex matches strings that match the given regular expression, it
+// panics if the expression cannot be compiled
+func Regex(pattern string) Matcher {
+	re := regexp.MustCompile(pattern)
+	return stringMatcher(fmt.Sprintf("Regex(%q)", pattern), re.MatchString)
+}
+
+// compare returns -1, 0 or 1 and true if a and b are numbers or strings
+// that can be compared
+func compare(a, b interface{}) (int, bool) {
+	if a == nil || b == nil {
+		return 0, false
+	}
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	switch {
+	case isInt(va) && isInt(vb):
+		return sign(va.Int() < vb.Int(), va.Int() > vb.Int()), true
+	case isUint(va) && isUint(vb):
+		return sign(va.Uint() < vb.Uint(), va.Uint() > vb.Uint()), true
+	case isNumber(va) && isNumber(vb):
+		fa, fb := toFloat(va), toFloat(vb)
+		return sign(fa < fb, fa > fb), true
+	case va.Kind() == reflect.String && vb.Kind() == reflect.String:
+		return strings.Compare(va.String(), vb.String()), true
+	}
+	return 0, false
+}
+
+func sign(less, greater bool) int {
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	}
+	return 0
+}
+
+func isInt(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return false
+}
+
+func isUint(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	}
+	return false
+}
+
+func isNumber(v reflect.Value) bool {
+	return isInt(v) || isUint(v) || v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64
+}
+
+func toFloat(v reflect.Value) float64 {
+	switch {
+	case isInt(v):
+		return float64(v.Int())
+	case isUint(v):
+		return float64(v.Uint())
+	}
+	return v.Float()
+}
+
+func comparison(name string, expected interface{}, matches func(int) bool) Matcher {
+	return newMatcher(name, func(actual interface{}) bool {
+		result, ok := compare(actual, expected)
+		return ok && matches(result)
+	})
+}
+
+// Gt matches numbers (or strings) greater than the expected value, the
+// numbers don't have to be of the same type, e.g. Gt(1) matches int64(2)
+func Gt(expected interface{}) Matcher {
+	return comparison(fmt.Sprintf("Gt(%#v)", expected), expected, func(result int) bool { return result > 0 })
+}
+
+func Ge(expected interface{}) Matcher {
+	return comparison(fmt.Sprintf("Ge(%#v)", expected), expected, func(result int) bool { return result >= 0 })
+}
+
+func Lt(expected interface{}) Matcher {
+	return comparison(fmt.Sprintf("Lt(%#v)", expected), expected, func(result int) bool { return result < 0 })
+}
+
+func Le(expected interface{}) Matcher {
+	return comparison(fmt.Sprintf("Le(%#v)", expected), expected, func(result int) bool { return result <= 0 })
+}
+
+// Len matches strings, slices, arrays, maps and channels of the given length
+func Len(length int) Matcher {
+	return newMatcher(fmt.Sprintf("Len(%d)", length), func(actual interface{}) bool {
+		if actual == nil {
+			return false
+		}
+		v := reflect.ValueOf(actual)
+		switch v.Kind() {
+		case reflect.String, reflect.Slice, reflect.Array, reflect.Map, reflect.Chan:
+			return v.Len() == length
+		}
+		return false
+	})
+}
+
+// OfType matches values that have the same type as the given example, e.g.
+// OfType(&Foo{}) matches any *Foo
+func OfType(example interface{}) Matcher {
+	expectedType := reflect.TypeOf(example)
+	return newMatcher(fmt.Sprintf("OfType(%s)", expectedType), func(actual interface{}) bool {
+		return reflect.TypeOf(actual) == expectedType
+	})
+}
+
+// ErrorIs matches errors e such that errors.Is(e, target) is true
+func ErrorIs(target error) Matcher {
+	return newMatcher(fmt.Sprintf("ErrorIs(%#v)", target), func(actual interface{}) bool {
+		err, ok := actual.(error)
+		return ok && errors.Is(err, target)
+	})
+}
+
+// ErrorAs matches errors e such that errors.As(e, target) is true, target
+// must be a non-nil pointer, e.g. ErrorAs(new(*os.PathError)). target
+// isn't modified.
+func ErrorAs(target interface{}) Matcher {
+	targetType := reflect.TypeOf(target)
+	if targetType == nil || targetType.Kind() != reflect.Ptr {
+		panic("ErrorAs: target must be a non-nil pointer")
+	}
+	return newMatcher(fmt.Sprintf("ErrorAs(%s)", targetType), func(actual interface{}) bool {
+		err, ok := actual.(error)
+		return ok && errors.As(err, reflect.New(targetType.Elem()).Interface())
+	})
+}
+
+// AllOf matches values that match all the given matchers
+func AllOf(matchers ...Matcher) Matcher {
+	return newMatcher(fmt.Sprintf("AllOf(%s)", describe(matchers)), func(actual interface{}) bool {
+		for _, m := range matchers {
+			if !m.Matches(actual) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// AnyOf matches values that match at least one of the given matchers
+func AnyOf(matchers ...Matcher) Matcher {
+	return newMatcher(fmt.Sprintf("AnyOf(%s)", describe(matchers)), func(actual interface{}) bool {
+		for _, m := range matchers {
+			if m.Matches(actual) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Not matches values that don't match the given matcher
+func Not(matcher Matcher) Matcher {
+	return newMatcher(fmt.Sprintf("Not(%s)", describe([]Matcher{matcher})), func(actual interface{}) bool {
+		return !matcher.Matches(actual)
+	})
+}
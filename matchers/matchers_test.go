@@ -0,0 +1,84 @@
+package matchers_test
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jvshahid/mock4go/matchers"
+	. "launchpad.net/gocheck"
+	"os"
+	"testing"
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+type MatchersSuite struct{}
+
+var _ = Suite(&MatchersSuite{})
+
+func assertMatches(c *C, matcher matchers.Matcher, matching []interface{}, notMatching []interface{}) {
+	for _, value := range matching {
+		c.Check(matcher.Matches(value), Equals, true, Commentf("%s should match %#v", matcher, value))
+	}
+	for _, value := range notMatching {
+		c.Check(matcher.Matches(value), Equals, false, Commentf("%s shouldn't match %#v", matcher, value))
+	}
+}
+
+func (s *MatchersSuite) TestAny(c *C) {
+	assertMatches(c, matchers.Any(), []interface{}{nil, 1, "foo", &struct{}{}}, nil)
+}
+
+func (s *MatchersSuite) TestEq(c *C) {
+	assertMatches(c, matchers.Eq([]string{"foo"}), []interface{}{[]string{"foo"}}, []interface{}{nil, []string{"bar"}, "foo"})
+}
+
+func (s *MatchersSuite) TestNil(c *C) {
+	var nilPtr *int
+	var nilErr error
+	assertMatches(c, matchers.Nil(), []interface{}{nil, nilPtr, nilErr, []int(nil), map[int]int(nil)}, []interface{}{0, "", &struct{}{}, []int{}})
+	assertMatches(c, matchers.NotNil(), []interface{}{0, "", []int{}}, []interface{}{nil, nilPtr})
+}
+
+func (s *MatchersSuite) TestStrings(c *C) {
+	assertMatches(c, matchers.Prefix("ba"), []interface{}{"bar", "ba"}, []interface{}{"foo", nil, 1})
+	assertMatches(c, matchers.Suffix("ar"), []interface{}{"bar"}, []interface{}{"baz", nil})
+	assertMatches(c, matchers.Contains("oo"), []interface{}{"foo", "oops"}, []interface{}{"bar", nil})
+	assertMatches(c, matchers.Regex("^b.r$"), []interface{}{"bar", "bor"}, []interface{}{"barr", nil})
+}
+
+func (s *MatchersSuite) TestComparisons(c *C) {
+	assertMatches(c, matchers.Gt(1), []interface{}{2, int64(2), uint8(2), 1.5}, []interface{}{1, 0, -1, "2", nil})
+	assertMatches(c, matchers.Ge(1), []interface{}{1, uint(1), 1.0}, []interface{}{0, 0.5})
+	assertMatches(c, matchers.Lt(uint(1)), []interface{}{0, uint8(0), -1}, []interface{}{1, 2})
+	assertMatches(c, matchers.Le(1.5), []interface{}{1, 1.5}, []interface{}{2})
+	assertMatches(c, matchers.Gt("b"), []interface{}{"c"}, []interface{}{"a", 1})
+}
+
+func (s *MatchersSuite) TestLen(c *C) {
+	assertMatches(c, matchers.Len(2), []interface{}{"ab", []int{1, 2}, [2]int{}, map[int]int{1: 1, 2: 2}}, []interface{}{"a", nil, 2})
+}
+
+func (s *MatchersSuite) TestOfType(c *C) {
+	assertMatches(c, matchers.OfType(&os.PathError{}), []interface{}{&os.PathError{Op: "open"}}, []interface{}{os.PathError{}, nil})
+}
+
+func (s *MatchersSuite) TestErrors(c *C) {
+	wrapped := fmt.Errorf("wrapped: %w", os.ErrNotExist)
+	pathErr := fmt.Errorf("wrapped: %w", &os.PathError{Op: "open", Err: os.ErrNotExist})
+	assertMatches(c, matchers.ErrorIs(os.ErrNotExist), []interface{}{wrapped, os.ErrNotExist, pathErr}, []interface{}{errors.New("foo"), nil, "foo"})
+	target := new(*os.PathError)
+	assertMatches(c, matchers.ErrorAs(target), []interface{}{pathErr}, []interface{}{wrapped, nil})
+	c.Assert(*target, IsNil)
+}
+
+func (s *MatchersSuite) TestCombinators(c *C) {
+	assertMatches(c, matchers.AllOf(matchers.Prefix("b"), matchers.Suffix("r")), []interface{}{"bar"}, []interface{}{"baz", "far"})
+	assertMatches(c, matchers.AnyOf(matchers.Prefix("b"), matchers.Suffix("r")), []interface{}{"bar", "baz", "far"}, []interface{}{"foo"})
+	assertMatches(c, matchers.Not(matchers.Prefix("b")), []interface{}{"foo", 1}, []interface{}{"bar"})
+}
+
+func (s *MatchersSuite) TestDescriptions(c *C) {
+	c.Assert(fmt.Sprint(matchers.AllOf(matchers.Prefix("b"), matchers.Not(matchers.Gt(1)), matchers.Any())), Equals, `AllOf(Prefix("b"), Not(Gt(1)), Any())`)
+}
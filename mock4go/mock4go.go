@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"strings"
 )
 
@@ -18,6 +19,7 @@ type Args struct {
 	Verbose        bool
 	Keep           bool
 	InstrumentOnly bool
+	Overlay        bool
 	Destination    string
 	cmd            []string // the command to run and its arguments
 	cmdArgs        []string // the command to run and its arguments
@@ -45,6 +47,8 @@ func readMock4goArgs(args *Args) (int, error) {
 			args.Verbose = true
 		case "-i", "--instrument-only":
 			args.InstrumentOnly = true
+		case "-o", "--overlay":
+			args.Overlay = true
 		}
 	}
 
@@ -125,6 +129,8 @@ Where:
     -d|--destination: destination directory where instrumented code will be created
     -k|--keep: don't delete instrumented code after running the tests
     -i|--instrument-only: don't run the tests, only instrument the code (error if used without -k)
+    -o|--overlay: write only the instrumented files and pass them to the go command using -overlay
+      instead of copying the packages, the test command must be go
   [test command]:
     The command to use to run the tests, e.g. mock4go go test ...., or mock4go gocov ....
     If not specified, it will default to 'go test'
@@ -138,6 +144,13 @@ Where:
   [test binary args]:
     The arguments to pass the test binary created.
 
+mock4go can also be used by the go command to instrument the packages while
+it builds them, the packages in GOROOT and the module cache aren't instrumented:
+  go test -toolexec=mock4go ./...
+
+In module mode the module, or the workspace, is copied to the destination
+directory and the tests are run from the copy.
+
 Examples:
   mock4go go test -v db -database=localhost:8080 (use the go test command with -v argument to test the db package)
   mock4go gocov -v db -database=localhost:8080   (use gocov instead)
@@ -146,7 +159,71 @@ Examples:
 	fmt.Printf(usage)
 }
 
+// Returns true if the first argument is a tool run by the go command with
+// -toolexec, e.g. $GOROOT/pkg/tool/linux_amd64/compile
+func isToolexec() bool {
+	if len(os.Args) < 2 {
+		return false
+	}
+	if os.Args[1] == "toolexec" {
+		return true
+	}
+	return filepath.IsAbs(os.Args[1]) && filepath.Base(filepath.Dir(filepath.Dir(os.Args[1]))) == "tool"
+}
+
+// Run the tool, instrumenting the compiled packages, and return its exit
+// code. The output of the tool is read by the go command, i.e. nothing
+// else should be written to stdout
+func toolexec() int {
+	tool := os.Args[1:]
+	if tool[0] == "toolexec" {
+		tool = tool[1:]
+	}
+	if len(tool) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: the tool to run is missing\n")
+		return 2
+	}
+	toolArgs, err := api.ToolexecArgs(tool[0], tool[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "mock4go: %s\n", err)
+		return 2
+	}
+	cmd := exec.Command(tool[0], toolArgs...)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	// the go command uses the version of the tools to cache the packages,
+	// the version of mock4go is added to it
+	versionOnly := len(toolArgs) == 1 && toolArgs[0] == "-V=full"
+	var output []byte
+	if versionOnly {
+		output, err = cmd.Output()
+	} else {
+		cmd.Stdout = os.Stdout
+		err = cmd.Run()
+	}
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode()
+		}
+		fmt.Fprintf(os.Stderr, "mock4go: %s\n", err)
+		return 2
+	}
+	if versionOnly {
+		version, err := api.ToolVersion(string(output))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "mock4go: %s\n", err)
+			return 2
+		}
+		fmt.Print(version)
+	}
+	return 0
+}
+
 func run() int {
+	if isToolexec() {
+		return toolexec()
+	}
+
 	args, err := parseArgs()
 	api.Log("args: %#v\n", args)
 
@@ -181,14 +258,42 @@ func run() int {
 		return 2
 	}
 
-	for _, packageName := range args.packages {
-		_, err := api.InstrumentPackage(packageName, tmpDir)
+	root, workFile, err := api.ModuleRoot()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		return 2
+	}
+
+	// the directory to run the tests from
+	dir := ""
+	if args.Overlay {
+		if path.Base(args.cmd[0]) != "go" {
+			fmt.Fprintf(os.Stderr, "Error: -o can only be used with the go command\n")
+			return 2
+		}
+		overlay, err := api.InstrumentOverlay(args.packages, args.Destination)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %s", err)
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			return 2
+		}
+		args.cmdArgs = append(args.cmdArgs, "-overlay="+overlay)
+	} else if root != "" {
+		dir, err = instrumentModule(args, root, workFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
 			return 2
 		}
+	} else {
+		for _, packageName := range args.packages {
+			_, err := api.InstrumentPackage(packageName, tmpDir)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %s", err)
+				return 2
+			}
+		}
+		api.InstrumentPackage(api.Mock4goImport, tmpDir)
+		os.Setenv("GOPATH", strings.Replace(tmpDir, "/src", "", -1))
 	}
-	api.InstrumentPackage(api.Mock4goImport, tmpDir)
 
 	// run the tests
 	cmd := args.cmd
@@ -196,12 +301,12 @@ func run() int {
 	cmd = append(cmd, args.packages...)
 	cmd = append(cmd, args.testArgs...)
 	goBinPath, err := exec.LookPath(args.cmd[0])
-	os.Setenv("GOPATH", strings.Replace(tmpDir, "/src", "", -1))
 
 	if !args.InstrumentOnly {
 		api.Log("command: %v\n", cmd)
 
 		proc, err := os.StartProcess(goBinPath, cmd, &os.ProcAttr{
+			Dir: dir,
 			Env: os.Environ(),
 			Files: []*os.File{
 				os.Stdin,
@@ -228,6 +333,34 @@ func run() int {
 	return 1
 }
 
+// Copy the module or the workspace in root to the destination directory
+// and instrument the packages of the main modules. Returns the directory
+// in the copy that corresponds to the current directory
+func instrumentModule(args *Args, root, workFile string) (string, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, cwd)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("the current directory %s is outside of the module %s", cwd, root)
+	}
+
+	moduleDir := path.Join(args.Destination, "module")
+	api.Log("copying %s to %s\n", root, moduleDir)
+	if err := api.CopyModule(root, moduleDir); err != nil {
+		return "", err
+	}
+	if err := api.InstrumentModule(args.packages, root, moduleDir); err != nil {
+		return "", err
+	}
+	if workFile != "" && os.Getenv("GOWORK") != "" {
+		// GOWORK was set explicitly, use the copy of the workspace
+		os.Setenv("GOWORK", filepath.Join(moduleDir, filepath.Base(workFile)))
+	}
+	return filepath.Join(moduleDir, rel), nil
+}
+
 func main() {
 	os.Exit(run())
 }
@@ -0,0 +1,226 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Returns the directory that contains the go.work file of the workspace
+// or the go.mod file of the main module and the path of the go.work
+// file, if any. The root is empty if the go command runs in GOPATH mode
+func ModuleRoot() (root string, workFile string, err error) {
+	out, err := exec.Command("go", "env", "GOWORK", "GOMOD").Output()
+	if err != nil {
+		return "", "", fmt.Errorf("cannot run go env: %s", err)
+	}
+	lines := strings.Split(string(out), "\n")
+	if len(lines) < 2 {
+		return "", "", fmt.Errorf("unexpected output of go env: %q", out)
+	}
+	workFile, modFile := strings.TrimSpace(lines[0]), strings.TrimSpace(lines[1])
+	if workFile != "" && workFile != "off" {
+		return filepath.Dir(workFile), workFile, nil
+	}
+	if modFile != "" && modFile != os.DevNull {
+		return filepath.Dir(modFile), "", nil
+	}
+	return "", "", nil
+}
+
+// Copy the module or the workspace in root to dst. The relative paths
+// of the replace and use directives that point outside of root are
+// rewritten to absolute paths so the copy uses the same modules
+func CopyModule(root, dst string) error {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	dst, err = filepath.Abs(dst)
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			if file == dst || (file != root && isVCSDir(info.Name())) {
+				return filepath.SkipDir
+			}
+			return os.MkdirAll(target, os.ModePerm)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Name() == "go.mod" || info.Name() == "go.work":
+			content, err := os.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			content = []byte(rewriteModFile(string(content), filepath.Dir(file), root))
+			return os.WriteFile(target, content, info.Mode())
+		case info.Mode().IsRegular():
+			return copyFile(file, target)
+		}
+		return nil
+	})
+}
+
+func isVCSDir(name string) bool {
+	return name == ".git" || name == ".hg" || name == ".svn" || name == ".bzr"
+}
+
+// Returns the content of the go.mod or go.work file in dir with the
+// relative paths that point outside of root replaced by absolute paths,
+// e.g. "replace foo => ../foo" and "use ../bar"
+func rewriteModFile(content, dir, root string) string {
+	lines := strings.Split(content, "\n")
+	block := ""
+	for idx, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		directive := block
+		switch {
+		case block != "" && fields[0] == ")":
+			block = ""
+			continue
+		case (fields[0] == "replace" || fields[0] == "use") && len(fields) > 1 && fields[1] == "(":
+			block = fields[0]
+			continue
+		case block == "" && (fields[0] == "replace" || fields[0] == "use"):
+			directive = fields[0]
+			fields = fields[1:]
+		}
+
+		var relative string
+		switch directive {
+		case "replace":
+			for i, field := range fields {
+				if field == "=>" && i+1 < len(fields) {
+					relative = fields[i+1]
+				}
+			}
+		case "use":
+			relative = fields[0]
+		}
+		if !strings.HasPrefix(relative, "./") && !strings.HasPrefix(relative, "../") &&
+			relative != "." && relative != ".." {
+			continue
+		}
+		absolute := filepath.Join(dir, relative)
+		if rel, err := filepath.Rel(root, absolute); err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+			// the directory is copied too
+			continue
+		}
+		lines[idx] = strings.Replace(line, relative, absolute, 1)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// the fields of the output of go list -json that are used to instrument
+// the packages
+type listedPackage struct {
+	ImportPath   string
+	Dir          string
+	Standard     bool
+	GoFiles      []string
+	CgoFiles     []string
+	TestGoFiles  []string
+	XTestGoFiles []string
+	Module       *struct {
+		Path string
+		Main bool
+	}
+}
+
+// Instrument the given packages and the packages they and their tests
+// import that belong to the main modules, i.e. the module in root or the
+// modules of the workspace. The packages in the module cache aren't
+// instrumented. root must have been copied to dst using CopyModule
+func InstrumentModule(patterns []string, root, dst string) error {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	packages, err := listPackages(patterns)
+	if err != nil {
+		return err
+	}
+	for _, pkg := range packages {
+		if pkg.Module == nil || !pkg.Module.Main {
+			continue
+		}
+		rel, err := filepath.Rel(root, pkg.Dir)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			Log("not instrumenting %s, it is outside of %s\n", pkg.ImportPath, root)
+			continue
+		}
+		Log("instrumenting package %s\n", pkg.ImportPath)
+		// instrument the original files and point the copies of the
+		// tests to the original ones using //line directives
+		dir := filepath.Join(dst, rel)
+		if _, err = instrumentPackageFiles(pkg.Dir, dir, pkg.GoFiles, pkg.CgoFiles, pkg.TestGoFiles); err != nil {
+			return err
+		}
+		for _, list := range [][]string{pkg.TestGoFiles, pkg.XTestGoFiles} {
+			for _, file := range list {
+				if err := copyGoFile(filepath.Join(pkg.Dir, file), filepath.Join(dir, file)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the packages that aren't in GOROOT and should be instrumented
+// among the given packages, their dependencies and the dependencies of
+// their tests
+func listPackages(patterns []string) ([]*listedPackage, error) {
+	args := append([]string{"list", "-deps", "-test", "-json"}, patterns...)
+	cmd := exec.Command("go", args...)
+	stderr := bytes.NewBufferString("")
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("cannot list the packages: %s\n%s", err, stderr)
+	}
+
+	packages := make([]*listedPackage, 0)
+	seen := make(map[string]bool)
+	decoder := json.NewDecoder(bytes.NewReader(out))
+	for {
+		pkg := &listedPackage{}
+		if err := decoder.Decode(pkg); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		// the packages are listed once more for each test that imports them
+		if pkg.Dir == "" || seen[pkg.Dir] || pkg.Standard {
+			continue
+		}
+		seen[pkg.Dir] = true
+		if SkipInstrumentation(pkg.ImportPath) {
+			continue
+		}
+		packages = append(packages, pkg)
+	}
+	return packages, nil
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	. "launchpad.net/gocheck"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func (s *Mock4goTestSuite) TestRewritingRelativeReplaceDirectives(c *C) {
+	goMod := `module example.com/app
+
+require example.com/lib v1.0.0
+
+replace example.com/lib => ../lib
+
+replace (
+	example.com/inside v1.0.0 => ./inside
+	example.com/outside v1.2.3 => ../../outside
+	example.com/remote => example.com/fork v1.0.0
+)
+`
+	c.Assert(rewriteModFile(goMod, "/src/app", "/src/app"), Equals, `module example.com/app
+
+require example.com/lib v1.0.0
+
+replace example.com/lib => /src/lib
+
+replace (
+	example.com/inside v1.0.0 => ./inside
+	example.com/outside v1.2.3 => /outside
+	example.com/remote => example.com/fork v1.0.0
+)
+`)
+}
+
+func (s *Mock4goTestSuite) TestRewritingRelativeUseDirectives(c *C) {
+	goWork := `go 1.21
+
+use ./app
+
+use (
+	./lib
+	../shared
+)
+`
+	c.Assert(rewriteModFile(goWork, "/src/ws", "/src/ws"), Equals, `go 1.21
+
+use ./app
+
+use (
+	./lib
+	/src/shared
+)
+`)
+}
+
+func (s *Mock4goTestSuite) TestCopyingAWorkspace(c *C) {
+	dst := c.MkDir()
+	c.Assert(CopyModule("testdata/modules/workspace", dst), IsNil)
+
+	lib, err := filepath.Abs("testdata/modules/lib")
+	c.Assert(err, IsNil)
+	goMod, err := os.ReadFile(filepath.Join(dst, "app", "go.mod"))
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(goMod), "replace example.com/lib => "+lib+"\n"), Equals, true, Commentf("%s", goMod))
+	// the modules of the workspace are copied with it
+	goWork, err := os.ReadFile(filepath.Join(dst, "go.work"))
+	c.Assert(err, IsNil)
+	original, err := os.ReadFile("testdata/modules/workspace/go.work")
+	c.Assert(err, IsNil)
+	c.Assert(string(goWork), Equals, string(original))
+	_, err = os.Stat(filepath.Join(dst, "app", "greet", "greet_test.go"))
+	c.Assert(err, IsNil)
+}
+
+func (s *Mock4goTestSuite) TestInstrumentingAModule(c *C) {
+	defer setenv("GO111MODULE", "on")()
+	defer setenv("GOWORK", "off")()
+	defer setenv("GOFLAGS", "")()
+	defer setenv("GOPROXY", "off")()
+	cwd, err := os.Getwd()
+	c.Assert(err, IsNil)
+	defer os.Chdir(cwd)
+	// go list runs in the current directory, the root is found the same
+	// way as the go command finds it
+	c.Assert(os.Chdir("testdata/modules/lib"), IsNil)
+	root, err := os.Getwd()
+	c.Assert(err, IsNil)
+
+	dst := c.MkDir()
+	c.Assert(CopyModule(root, dst), IsNil)
+	c.Assert(InstrumentModule([]string{"./..."}, root, dst), IsNil)
+	content, err := os.ReadFile(filepath.Join(dst, "lib.go"))
+	c.Assert(err, IsNil)
+	c.Assert(strings.HasPrefix(string(content), lineDirective(filepath.Join(root, "lib.go"))), Equals, true, Commentf("%s", content))
+	c.Assert(strings.Contains(string(content), ".FunctionCalled(Greeting)"), Equals, true, Commentf("%s", content))
+}
+
+// Set the environment variable and return a function that restores it
+func setenv(name, value string) func() {
+	old, ok := os.LookupEnv(name)
+	os.Setenv(name, value)
+	return func() {
+		if ok {
+			os.Setenv(name, old)
+		} else {
+			os.Unsetenv(name)
+		}
+	}
+}
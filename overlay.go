@@ -0,0 +1,52 @@
+package api
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// the format of the file passed to go build -overlay
+type overlay struct {
+	Replace map[string]string
+}
+
+// Instrument the given packages and the packages they and their tests
+// import without copying them. Only the instrumented files are written to
+// dst and the returned overlay file maps the original files to them, e.g.
+//
+//	go test -overlay=/tmp/mock4go/overlay.json ./...
+//
+// This way the packages keep their paths and the build cache is reused.
+// In module mode only the packages of the main modules are instrumented
+func InstrumentOverlay(patterns []string, dst string) (string, error) {
+	dst, err := filepath.Abs(dst)
+	if err != nil {
+		return "", err
+	}
+	packages, err := listPackages(patterns)
+	if err != nil {
+		return "", err
+	}
+	o := overlay{Replace: make(map[string]string)}
+	for _, pkg := range packages {
+		if pkg.Module != nil && !pkg.Module.Main {
+			continue
+		}
+		Log("instrumenting package %s\n", pkg.ImportPath)
+		files, err := instrumentPackageFiles(pkg.Dir, filepath.Join(dst, "files", pkg.ImportPath), pkg.GoFiles, pkg.CgoFiles, pkg.TestGoFiles)
+		if err != nil {
+			return "", err
+		}
+		for src, instrumented := range files {
+			o.Replace[src] = instrumented
+		}
+	}
+
+	content, err := json.MarshalIndent(o, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	overlayFile := filepath.Join(dst, "overlay.json")
+	return overlayFile, os.WriteFile(overlayFile, content, 0644)
+}
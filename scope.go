@@ -0,0 +1,182 @@
+package api
+
+import (
+	"context"
+	"reflect"
+	"runtime/pprof"
+	"strconv"
+	"unsafe"
+)
+
+// Returns the profiler labels of the current goroutine, a goroutine
+// inherits the labels of the goroutine that created it. The runtime keeps
+// this symbol available to linkname, see go.dev/issue/67401
+//
+//go:linkname runtime_getProfLabel runtime/pprof.runtime_getProfLabel
+func runtime_getProfLabel() unsafe.Pointer
+
+// Scope has its own stubs, calls journal and strict mode settings that
+// only apply to calls made from the goroutine that created the scope (the
+// test goroutine) and the goroutines it created directly or indirectly.
+// This makes it possible to use mock4go in tests that call t.Parallel(),
+// e.g.
+//
+//	func TestFoo(t *testing.T) {
+//		t.Parallel()
+//		ctrl := NewScope(t)
+//		ctrl.Mock(func() {
+//			When(Foo()).Return("bar")
+//		})
+//		...
+//	}
+//
+// The calls made inside a scope don't use the global stubs. The scope is
+// removed when the test finishes. The goroutines are tracked using a
+// "mock4go.scope" profiler label, which the goroutines inherit when they
+// are created even if their parent exited since. A goroutine that replaces
+// its labels, e.g. using pprof.Do, leaves the scope unless the new labels
+// are derived from a context that has the label, see Scope.Context.
+type Scope struct {
+	t         TB
+	goroutine int64
+	labels    unsafe.Pointer
+	registry  *registry
+}
+
+// the key pprof uses to store the profiler labels in a context, found by
+// looking at the keys pprof.Label asks for
+var labelsKey interface{}
+
+// the type of the profiler labels stored in a context
+var labelsType reflect.Type
+
+func init() {
+	ctx := &keyRecorder{Context: context.Background()}
+	pprof.Label(ctx, "")
+	labelsKey = ctx.key
+	labels := pprof.WithLabels(context.Background(), pprof.Labels("mock4go.scope", ""))
+	labelsType = reflect.TypeOf(labels.Value(labelsKey))
+}
+
+type keyRecorder struct {
+	context.Context
+	key interface{}
+}
+
+func (c *keyRecorder) Value(key interface{}) interface{} {
+	c.key = key
+	return c.Context.Value(key)
+}
+
+// Returns a context with the profiler labels of the current goroutine
+func goroutineLabels() context.Context {
+	labels := runtime_getProfLabel()
+	if labels == nil || labelsType == nil || labelsType.Kind() != reflect.Ptr {
+		return context.Background()
+	}
+	value := reflect.NewAt(labelsType.Elem(), labels).Interface()
+	return context.WithValue(context.Background(), labelsKey, value)
+}
+
+// the scopes by the id of the goroutine that created them
+var scopes = make(map[int64]*Scope)
+
+// the scopes by the profiler labels of the goroutine that created them
+var labeledScopes = make(map[unsafe.Pointer]*Scope)
+
+func NewScope(t TB) *Scope {
+	lock.Lock()
+	defer lock.Unlock()
+	s := &Scope{
+		t:         t,
+		goroutine: goroutineID(),
+		registry:  newRegistry(),
+	}
+	// keep the labels the test already has, e.g. when it runs in pprof.Do
+	previous := goroutineLabels()
+	pprof.SetGoroutineLabels(s.Context(previous))
+	s.labels = runtime_getProfLabel()
+	scopes[s.goroutine] = s
+	labeledScopes[s.labels] = s
+	t.Cleanup(func() {
+		lock.Lock()
+		defer lock.Unlock()
+		if goroutineID() == s.goroutine && runtime_getProfLabel() == s.labels {
+			pprof.SetGoroutineLabels(previous)
+		}
+		if scopes[s.goroutine] == s {
+			delete(scopes, s.goroutine)
+		}
+		if labeledScopes[s.labels] == s {
+			delete(labeledScopes, s.labels)
+		}
+	})
+	return s
+}
+
+// Returns a context with the label of the scope, the goroutines that use
+// it with pprof.Do or pprof.SetGoroutineLabels stay in the scope
+func (s *Scope) Context(parent context.Context) context.Context {
+	labels := pprof.Labels("mock4go.scope", strconv.FormatInt(s.goroutine, 10))
+	return pprof.WithLabels(parent, labels)
+}
+
+// Same as MockT but the stubs are added to the scope
+func (s *Scope) Mock(fun func()) {
+	defer stopRecording(startRecording(&recorder{registry: s.registry, reporter: s.t}))
+	fun()
+}
+
+func (s *Scope) Spy(fun function) *functionCall {
+	return s.registry.spy(fun)
+}
+
+// Same as Strict but reports the failures to the scope's test
+func (s *Scope) Strict(funs ...function) {
+	s.registry.strict(s.t, funs)
+}
+
+// Same as Verifying but reports the failures to the scope's test
+func (s *Scope) Verifying(fun func()) {
+	s.registry.verifying(s.t, fun)
+}
+
+func (s *Scope) Calls(fun function) []*Call {
+	return s.registry.calls(fun)
+}
+
+func (s *Scope) LastCall(fun function) *Call {
+	return s.registry.lastCall(fun)
+}
+
+// Same as ResetMocks but only resets the scope
+func (s *Scope) Reset() {
+	lock.Lock()
+	defer lock.Unlock()
+	s.registry = newRegistry()
+}
+
+// Returns the registry of the scope the current goroutine belongs to or
+// the global registry, must be called while holding the lock
+func registryFor() *registry {
+	if len(scopes) == 0 {
+		return global
+	}
+	if scope := labeledScopes[runtime_getProfLabel()]; scope != nil {
+		return scope.registry
+	}
+	// the goroutine changed its labels, e.g. using pprof.Do, look for the
+	// label of the scope in the new labels
+	value, ok := pprof.Label(goroutineLabels(), "mock4go.scope")
+	if !ok {
+		return global
+	}
+	goroutine, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return global
+	}
+	if scope := scopes[goroutine]; scope != nil {
+		return scope.registry
+	}
+	return global
+}
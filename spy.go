@@ -0,0 +1,92 @@
+package api
+
+import (
+	"reflect"
+)
+
+// number of pending calls to the real implementation per goroutine and
+// function, the next call to FunctionCalled for that function from that
+// goroutine falls through
+var bypass = make(map[bypassKey]int)
+
+// Spy on the given function, all the calls are recorded with the values
+// returned by the real implementation, e.g.
+//
+//	Spy(Foo)
+//	Foo("x")
+//	c.Assert(LastCall(Foo).RealReturned, DeepEquals, []interface{}{"x"})
+//
+// Inside MockT the spy is removed with the stubs when the test finishes
+func Spy(fun function) *functionCall {
+	r := currentRecorder()
+	if r.registry == nil {
+		return global.spy(fun)
+	}
+	call := r.registry.spy(fun)
+	lock.Lock()
+	defer lock.Unlock()
+	r.created = append(r.created, call)
+	return call
+}
+
+func (r *registry) spy(fun function) *functionCall {
+	call := &functionCall{fun: fun, responses: []*response{{callReal: true}}}
+	lock.Lock()
+	defer lock.Unlock()
+	r.addFunctionCall(getFunType(fun), call)
+	return call
+}
+
+// Call the real implementation when the stub is used
+func (m *functionCall) CallRealMethod() *functionCall {
+	return m.update(func() {
+		m.responses = []*response{{callReal: true}}
+	})
+}
+
+// Same as ThenReturn but calls the real implementation
+func (m *functionCall) ThenCallRealMethod() *functionCall {
+	return m.update(func() {
+		m.responses = append(m.responses, &response{callReal: true})
+	})
+}
+
+// Process the values returned by the real implementation before they are
+// returned to the caller. Must follow CallRealMethod or ThenCallRealMethod
+func (m *functionCall) ProcessResults(process func(returned []interface{}) []interface{}) *functionCall {
+	callsReal := false
+	m.update(func() {
+		if len(m.responses) > 0 && m.responses[len(m.responses)-1].callReal {
+			m.responses[len(m.responses)-1].process = process
+			callsReal = true
+		}
+	})
+	if !callsReal && m.fun != nil {
+		m.fail("ProcessResults: %s doesn't call the real implementation", funcName(m.fun))
+	}
+	return m
+}
+
+func callRealFunction(call *Call, args []interface{}, process func([]interface{}) []interface{}) []interface{} {
+	defer func() {
+		if err := recover(); err != nil {
+			lock.Lock()
+			call.Panicked = true
+			call.Panic = err
+			lock.Unlock()
+			panic(err)
+		}
+	}()
+
+	lock.Lock()
+	bypass[bypassKey{goroutineID(), call.funType}]++
+	lock.Unlock()
+	values := callFunction(reflect.ValueOf(call.fun), args)
+	lock.Lock()
+	call.RealReturned = values
+	lock.Unlock()
+	if process != nil {
+		values = process(values)
+	}
+	return values
+}
@@ -2,11 +2,15 @@ package test
 
 import (
 	"errors"
+	"fmt"
 	. "github.com/jvshahid/mock4go"
+	"github.com/jvshahid/mock4go/matchers"
 	. "launchpad.net/gocheck"
 	"os"
 	"reflect"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -110,6 +114,27 @@ func (suite *Mock4goSuite) TestMockingWithMatchers(c *C) {
 	c.Assert(val, Equals, "foobar")
 }
 
+func (suite *Mock4goSuite) TestPointerArgumentsMatchTheSamePointer(c *C) {
+	foo := &Foo{Field: "foo"}
+	Mock(func() {
+		When(foo.OneReturnValue()).Return("bar")
+	})
+	// an equal value at another address doesn't match
+	c.Assert((&Foo{Field: "foo"}).OneReturnValue(), Equals, "foo")
+	c.Assert(foo.OneReturnValue(), Equals, "bar")
+}
+
+func (suite *Mock4goSuite) TestOtherArgumentsMatchDeeplyEqualValues(c *C) {
+	StructArgumentsNoReceiver(Foo{Field: "foo"}, map[string]int{"one": 1}, []string{"foo"})
+	StructArgumentsNoReceiver(Foo{Field: "bar"}, map[string]int{"one": 1}, []string{"foo"})
+	Verifying(c, func() {
+		StructArgumentsNoReceiver(Foo{Field: "foo"}, map[string]int{"one": 1}, []string{"foo"})
+		Verify().Once()
+		StructArgumentsNoReceiver(Foo{Field: "foo"}, map[string]int{"one": 2}, []string{"foo"})
+		Verify().Never()
+	})
+}
+
 func (suite *Mock4goSuite) TestMockingFunctionWithNoReturnValues(c *C) {
 	foo := &Foo{Field: ""}
 	bar := &Foo{Field: ""}
@@ -156,3 +181,697 @@ func (suite *Mock4goSuite) TestMockingEmbeddedInterface(c *C) {
 	c.Assert(mock.Value(), Equals, "foo")
 	c.Assert(mock.AnotherValue(), Equals, "bar")
 }
+
+type fakeReporter struct {
+	errors []string
+}
+
+func (r *fakeReporter) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (suite *Mock4goSuite) TestVerifyingCallCounts(c *C) {
+	OneReturnValueNoReceiver()
+	OneReturnValueNoReceiver()
+	MultipleReturnValuesNoReceiver("foo")
+	Verifying(c, func() {
+		Verify(OneReturnValueNoReceiver()).Times(2)
+		Verify(MultipleReturnValuesNoReceiver("foo")).Once()
+		Verify(MultipleReturnValuesNoReceiver("bar")).Never()
+		Verify(MultipleReturnValuesNoReceiver("")).AnyArguments().AtLeast(1)
+		Verify(MultipleReturnValuesNoReceiver("")).WithMatchers(&PrefixMatcher{value: "f"}).AtMost(1)
+		Verify(OneReturnValueNoReceiver2()).Never()
+	})
+}
+
+func (suite *Mock4goSuite) TestVerifyingStubbedCalls(c *C) {
+	foo := &Foo{}
+	Mock(func() {
+		When(foo.OneReturnValue()).Return("bar")
+	})
+	c.Assert(foo.OneReturnValue(), Equals, "bar")
+	(&Foo{}).OneReturnValue()
+	Verifying(c, func() {
+		Verify(foo.OneReturnValue()).Once()
+	})
+}
+
+func (suite *Mock4goSuite) TestVerifyingFailureListsActualCalls(c *C) {
+	MultipleReturnValuesNoReceiver("foo")
+	reporter := &fakeReporter{}
+	Verifying(reporter, func() {
+		c.Assert(Verify(MultipleReturnValuesNoReceiver("bar")).Times(2), Equals, false)
+		c.Assert(Verify(OneReturnValueNoReceiver()).AtLeast(1), Equals, false)
+	})
+	c.Assert(reporter.errors, HasLen, 2)
+	c.Assert(reporter.errors[0], Equals, `expected test.MultipleReturnValuesNoReceiver("bar") to be called exactly 2 times, but it was called 0 times
+actual calls:
+    test.MultipleReturnValuesNoReceiver("foo")
+        argument 0: expected "bar", got "foo"`)
+	c.Assert(reporter.errors[1], Equals, `expected test.OneReturnValueNoReceiver() to be called at least 1 time, but it was called 0 times
+actual calls:
+    none`)
+}
+
+func (suite *Mock4goSuite) TestVerifyWithoutAnInstrumentedCall(c *C) {
+	reporter := &fakeReporter{}
+	Verifying(reporter, func() {
+		c.Assert(Verify(OneReturnValueNoReceiver()).Never(), Equals, true)
+		// the previous verification isn't checked again
+		c.Assert(Verify(notInstrumented()).Never(), Equals, false)
+		c.Assert(InOrder(reporter, Verify(notInstrumented()).AnyArguments()), Equals, false)
+	})
+	c.Assert(reporter.errors, HasLen, 2)
+	for _, err := range reporter.errors {
+		c.Assert(err, Matches, ".*: Verify: no instrumented call recorded")
+	}
+	c.Assert(func() { Verify(notInstrumented()) }, PanicMatches, ".*: Verify: no instrumented call recorded")
+}
+
+func (suite *Mock4goSuite) TestCallsJournal(c *C) {
+	expectedErr := errors.New("foobar")
+	var stub interface{}
+	Mock(func() {
+		stub = When(MultipleReturnValuesNoReceiver("bar")).Return("foobar", expectedErr)
+	})
+	c.Assert(LastCall(MultipleReturnValuesNoReceiver), IsNil)
+	MultipleReturnValuesNoReceiver("foo")
+	MultipleReturnValuesNoReceiver("bar")
+
+	calls := Calls(MultipleReturnValuesNoReceiver)
+	c.Assert(calls, HasLen, 2)
+	c.Assert(calls[0].Receiver, IsNil)
+	c.Assert(calls[0].Args, DeepEquals, []interface{}{"foo"})
+	c.Assert(calls[0].Matched, Equals, false)
+	c.Assert(calls[0].Returned, IsNil)
+	c.Assert(calls[1].Args, DeepEquals, []interface{}{"bar"})
+	c.Assert(calls[1].Matched, Equals, true)
+	c.Assert(calls[1].Returned, DeepEquals, []interface{}{"foobar", expectedErr})
+	c.Assert(calls[1].Stub, Equals, stub)
+	c.Assert(LastCall(MultipleReturnValuesNoReceiver), Equals, calls[1])
+	c.Assert(Calls(OneReturnValueNoReceiver), HasLen, 0)
+
+	ResetMocks()
+	c.Assert(Calls(MultipleReturnValuesNoReceiver), HasLen, 0)
+}
+
+func (suite *Mock4goSuite) TestCallsJournalWithReceiver(c *C) {
+	foo := &Foo{}
+	foo.NoReturnValues("foo")
+	call := LastCall((*Foo).NoReturnValues)
+	c.Assert(call, NotNil)
+	c.Assert(call.Receiver, Equals, foo)
+	c.Assert(call.Args, DeepEquals, []interface{}{"foo"})
+
+	mock := &MockTestInterfaceMethodWithArgs{}
+	mock.Value("John", "Doe")
+	call = LastCall((*MockTestInterfaceMethodWithArgs).Value)
+	c.Assert(call, NotNil)
+	c.Assert(call.Receiver, Equals, mock)
+	c.Assert(call.Args, DeepEquals, []interface{}{"John", "Doe"})
+}
+
+func (suite *Mock4goSuite) TestStubbingWithDo(c *C) {
+	Mock(func() {
+		When(MultipleReturnValuesNoReceiver("")).
+			WithMatchers(&PrefixMatcher{value: "ba"}).
+			Do(func(value string) (string, error) {
+				return strings.ToUpper(value), nil
+			})
+	})
+	val, err := MultipleReturnValuesNoReceiver("bar")
+	c.Assert(err, IsNil)
+	c.Assert(val, Equals, "BAR")
+	val, err = MultipleReturnValuesNoReceiver("foo")
+	c.Assert(err, IsNil)
+	c.Assert(val, Equals, "foo")
+	c.Assert(Calls(MultipleReturnValuesNoReceiver)[0].Returned, DeepEquals, []interface{}{"BAR", nil})
+}
+
+func (suite *Mock4goSuite) TestStubbingMethodWithDo(c *C) {
+	foo := &Foo{Field: "foo"}
+	Mock(func() {
+		When(foo.MultipleReturnValues()).Do(func(f *Foo) (string, error) {
+			return "", fmt.Errorf("%s failed", f.Field)
+		})
+	})
+	val, err := foo.MultipleReturnValues()
+	c.Assert(val, Equals, "")
+	c.Assert(err, ErrorMatches, "foo failed")
+}
+
+func (suite *Mock4goSuite) TestStubbingWithDoValidatesTheSignature(c *C) {
+	Mock(func() {
+		c.Assert(func() {
+			When(MultipleReturnValuesNoReceiver("")).Do(func(value string) string {
+				return value
+			})
+		}, PanicMatches, `Do: expected a function of type func\(string\) \(string, error\) but got func\(string\) string`)
+	})
+}
+
+func (suite *Mock4goSuite) TestStubbingWithSequenceOfReturnValues(c *C) {
+	expectedErr := errors.New("foobar")
+	Mock(func() {
+		When(MultipleReturnValuesNoReceiver("foo")).
+			Return("", expectedErr).
+			ThenReturn("", expectedErr).
+			ThenReturn("bar", nil)
+	})
+	for i := 0; i < 2; i++ {
+		_, err := MultipleReturnValuesNoReceiver("foo")
+		c.Assert(err, Equals, expectedErr)
+	}
+	for i := 0; i < 2; i++ {
+		val, err := MultipleReturnValuesNoReceiver("foo")
+		c.Assert(err, IsNil)
+		c.Assert(val, Equals, "bar")
+	}
+}
+
+func (suite *Mock4goSuite) TestStubbingWithReturnOnce(c *C) {
+	Mock(func() {
+		When(OneReturnValueNoReceiver()).ReturnOnce("bar")
+	})
+	c.Assert(OneReturnValueNoReceiver(), Equals, "bar")
+	c.Assert(OneReturnValueNoReceiver(), Equals, "foo")
+}
+
+func (suite *Mock4goSuite) TestStubbingWithTimesFallsThroughToTheNextStub(c *C) {
+	Mock(func() {
+		When(OneReturnValueNoReceiver()).Return("bar").Times(2)
+		When(OneReturnValueNoReceiver()).Return("baz").ThenDo(func() string {
+			return "qux"
+		}).Times(2)
+	})
+	c.Assert(OneReturnValueNoReceiver(), Equals, "bar")
+	c.Assert(OneReturnValueNoReceiver(), Equals, "bar")
+	c.Assert(OneReturnValueNoReceiver(), Equals, "baz")
+	c.Assert(OneReturnValueNoReceiver(), Equals, "qux")
+	c.Assert(OneReturnValueNoReceiver(), Equals, "foo")
+}
+
+func (suite *Mock4goSuite) TestSpying(c *C) {
+	Spy(MultipleReturnValuesNoReceiver)
+	val, err := MultipleReturnValuesNoReceiver("foo")
+	c.Assert(err, IsNil)
+	c.Assert(val, Equals, "foo")
+	call := LastCall(MultipleReturnValuesNoReceiver)
+	c.Assert(call.Matched, Equals, true)
+	c.Assert(call.RealReturned, DeepEquals, []interface{}{"foo", nil})
+	c.Assert(call.Returned, DeepEquals, []interface{}{"foo", nil})
+}
+
+func (suite *Mock4goSuite) TestCallingTheRealMethod(c *C) {
+	foo := &Foo{Field: "foo"}
+	Mock(func() {
+		When(foo.OneReturnValue()).Return("bar").ThenCallRealMethod()
+	})
+	c.Assert(foo.OneReturnValue(), Equals, "bar")
+	c.Assert(foo.OneReturnValue(), Equals, "foo")
+	c.Assert(Calls((*Foo).OneReturnValue), HasLen, 2)
+}
+
+func (suite *Mock4goSuite) TestCallingTheRealMethodAndProcessingTheResults(c *C) {
+	Mock(func() {
+		When(MultipleReturnValuesNoReceiver("foo")).
+			CallRealMethod().
+			ProcessResults(func(returned []interface{}) []interface{} {
+				return []interface{}{returned[0].(string) + "bar", returned[1]}
+			})
+	})
+	val, err := MultipleReturnValuesNoReceiver("foo")
+	c.Assert(err, IsNil)
+	c.Assert(val, Equals, "foobar")
+	call := LastCall(MultipleReturnValuesNoReceiver)
+	c.Assert(call.RealReturned, DeepEquals, []interface{}{"foo", nil})
+	c.Assert(call.Returned, DeepEquals, []interface{}{"foobar", nil})
+}
+
+func (suite *Mock4goSuite) TestSpyingOnPanics(c *C) {
+	Spy(PanicsNoReceiver)
+	c.Assert(func() { PanicsNoReceiver("foo") }, PanicMatches, "foo")
+	call := LastCall(PanicsNoReceiver)
+	c.Assert(call.Panicked, Equals, true)
+	c.Assert(call.Panic, Equals, "foo")
+	c.Assert(Calls(PanicsNoReceiver), HasLen, 1)
+}
+
+func (suite *Mock4goSuite) TestStubbingWithPanic(c *C) {
+	Mock(func() {
+		When(OneReturnValueNoReceiver()).Return("bar").ThenPanic("foobar")
+		When(OneReturnValueNoReceiver2()).Panic("baz")
+	})
+	c.Assert(OneReturnValueNoReceiver(), Equals, "bar")
+	c.Assert(func() { OneReturnValueNoReceiver() }, PanicMatches, "foobar")
+	c.Assert(func() { OneReturnValueNoReceiver2() }, PanicMatches, "baz")
+	call := LastCall(OneReturnValueNoReceiver)
+	c.Assert(call.Panicked, Equals, true)
+	c.Assert(call.Panic, Equals, "foobar")
+}
+
+func (suite *Mock4goSuite) TestStubbingWithReturnError(c *C) {
+	expectedErr := errors.New("foobar")
+	Mock(func() {
+		When(WideReturnValuesNoReceiver()).ReturnError(expectedErr).ThenReturnError(nil)
+	})
+	s, i, foo, err := WideReturnValuesNoReceiver()
+	c.Assert(s, Equals, "")
+	c.Assert(i, Equals, 0)
+	c.Assert(foo, IsNil)
+	c.Assert(err, Equals, expectedErr)
+	s, _, _, err = WideReturnValuesNoReceiver()
+	c.Assert(s, Equals, "")
+	c.Assert(err, IsNil)
+}
+
+func (suite *Mock4goSuite) TestReturnErrorRequiresAnErrorResult(c *C) {
+	Mock(func() {
+		c.Assert(func() {
+			When(OneReturnValueNoReceiver()).ReturnError(errors.New("foobar"))
+		}, PanicMatches, "ReturnError: test.OneReturnValueNoReceiver doesn't return an error")
+	})
+}
+
+func (suite *Mock4goSuite) TestStrictMode(c *C) {
+	reporter := &fakeReporter{}
+	Strict(reporter)
+	Mock(func() {
+		When(MultipleReturnValuesNoReceiver("bar")).Return("foobar", nil)
+		When(MultipleReturnValuesNoReceiver("")).WithMatchers(&PrefixMatcher{value: "ba"}).ReturnOnce("baz", nil)
+	})
+	val, err := MultipleReturnValuesNoReceiver("baz")
+	c.Assert(val, Equals, "baz")
+	val, err = MultipleReturnValuesNoReceiver("foo")
+	c.Assert(val, Equals, "")
+	c.Assert(err, IsNil)
+	// functions without stubs aren't affected
+	c.Assert(OneReturnValueNoReceiver(), Equals, "foo")
+	c.Assert(reporter.errors, HasLen, 1)
+	c.Assert(reporter.errors[0], Equals, `unexpected call test.MultipleReturnValuesNoReceiver("foo")
+registered stubs:
+    test.MultipleReturnValuesNoReceiver("bar")
+        argument 0: expected "bar", got "foo"
+    test.MultipleReturnValuesNoReceiver(&test.PrefixMatcher{value:"ba"}) (exhausted after 1 time)
+        argument 0: expected &test.PrefixMatcher{value:"ba"}, got "foo"`)
+}
+
+func (suite *Mock4goSuite) TestStrictModeWithInstrumentedMatchers(c *C) {
+	reporter := &fakeReporter{}
+	Strict(reporter)
+	Mock(func() {
+		When(MultipleReturnValuesNoReceiver("")).WithMatchers(&LengthMatcher{Length: 2}).Return("bar", nil)
+	})
+	val, _ := MultipleReturnValuesNoReceiver("ba")
+	c.Assert(val, Equals, "bar")
+	MultipleReturnValuesNoReceiver("foo")
+	c.Assert(reporter.errors, DeepEquals, []string{`unexpected call test.MultipleReturnValuesNoReceiver("foo")
+registered stubs:
+    test.MultipleReturnValuesNoReceiver(a string of length 2)
+        argument 0: expected a string of length 2, got "foo"`})
+}
+
+func (suite *Mock4goSuite) TestVerifyingWithInstrumentedMatchers(c *C) {
+	MultipleReturnValuesNoReceiver("foo")
+	reporter := &fakeReporter{}
+	Verifying(reporter, func() {
+		Verify(MultipleReturnValuesNoReceiver("")).WithMatchers(&LengthMatcher{Length: 3}).Once()
+		Verify(MultipleReturnValuesNoReceiver("")).WithMatchers(&LengthMatcher{Length: 2}).Once()
+	})
+	c.Assert(reporter.errors, DeepEquals, []string{`expected test.MultipleReturnValuesNoReceiver(a string of length 2) to be called exactly 1 time, but it was called 0 times
+actual calls:
+    test.MultipleReturnValuesNoReceiver("foo")
+        argument 0: expected a string of length 2, got "foo"`})
+}
+
+func (suite *Mock4goSuite) TestStrictModePerFunction(c *C) {
+	reporter := &fakeReporter{}
+	Strict(reporter, OneReturnValueNoReceiver)
+	Mock(func() {
+		When(MultipleReturnValuesNoReceiver("bar")).Return("foobar", nil)
+		When(OneReturnValueNoReceiver()).ReturnOnce("bar")
+	})
+	val, _ := MultipleReturnValuesNoReceiver("foo")
+	c.Assert(val, Equals, "foo")
+	c.Assert(OneReturnValueNoReceiver(), Equals, "bar")
+	c.Assert(OneReturnValueNoReceiver(), Equals, "")
+	c.Assert(reporter.errors, HasLen, 1)
+}
+
+func (suite *Mock4goSuite) TestConcurrentCalls(c *C) {
+	Mock(func() {
+		When(MultipleReturnValuesNoReceiver("bar")).Return("foobar", nil)
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				val, _ := MultipleReturnValuesNoReceiver("bar")
+				c.Check(val, Equals, "foobar")
+				val = OneReturnValueNoReceiver()
+				c.Check(val == "foo" || val == "bar", Equals, true)
+				(&Foo{Field: "foo"}).OneReturnValue()
+			}
+		}()
+	}
+	// calls made from the other goroutines while mocking aren't stubs
+	Mock(func() {
+		When(OneReturnValueNoReceiver()).Return("bar")
+	})
+	Spy((*Foo).OneReturnValue)
+	Strict(c, MultipleReturnValuesNoReceiver)
+	wg.Wait()
+	c.Assert(Calls(MultipleReturnValuesNoReceiver), HasLen, 1000)
+	c.Assert(Calls(OneReturnValueNoReceiver), HasLen, 1000)
+	c.Assert(OneReturnValueNoReceiver(), Equals, "bar")
+	Verifying(c, func() {
+		Verify(MultipleReturnValuesNoReceiver("bar")).Times(1000)
+	})
+}
+
+func (suite *Mock4goSuite) TestReturnValuesAreConvertedToTheResultTypes(c *C) {
+	Mock(func() {
+		When(TypedReturnValuesNoReceiver()).Return(1, 2, []string{"foo"}, nil, nil)
+	})
+	i, f, names, stringer, foo := TypedReturnValuesNoReceiver()
+	c.Assert(i, Equals, int64(1))
+	c.Assert(f, Equals, float32(2))
+	c.Assert(names, DeepEquals, Names{"foo"})
+	c.Assert(stringer, IsNil)
+	c.Assert(foo, IsNil)
+}
+
+func (suite *Mock4goSuite) TestReturnValuesAreValidated(c *C) {
+	Mock(func() {
+		c.Assert(func() {
+			When(MultipleReturnValuesNoReceiver("foo")).Return("bar")
+		}, PanicMatches, `.*/mock4go_test.go:\d+: Return: expected 2 values for test.MultipleReturnValuesNoReceiver but got 1`)
+		c.Assert(func() {
+			When(MultipleReturnValuesNoReceiver("foo")).Return(nil, nil)
+		}, PanicMatches, `.*: Return: cannot use value 0 as string: nil isn't a valid string`)
+		c.Assert(func() {
+			When(MultipleReturnValuesNoReceiver("foo")).Return("bar", "baz")
+		}, PanicMatches, `.*: Return: cannot use value 1 as error: "baz" of type string isn't assignable to error`)
+		c.Assert(func() {
+			When(TypedReturnValuesNoReceiver()).Return(1.5, 2, nil, nil, nil)
+		}, PanicMatches, `.*: Return: cannot use value 0 as int64: 1.5 overflows or loses precision`)
+		c.Assert(func() {
+			When(OneReturnValueNoReceiver()).Return("bar").ThenReturn(1)
+		}, PanicMatches, `.*: ThenReturn: cannot use value 0 as string: 1 of type int isn't assignable to string`)
+	})
+}
+
+func (suite *Mock4goSuite) TestStubsWithoutReturnValuesReturnTheZeroValues(c *C) {
+	Mock(func() {
+		OneReturnValueNoReceiver()
+	})
+	c.Assert(OneReturnValueNoReceiver(), Equals, "")
+}
+
+func (suite *Mock4goSuite) TestMockingWithBuiltInMatchers(c *C) {
+	Mock(func() {
+		When(MultipleReturnValuesNoReceiver("")).
+			WithMatchers(matchers.AllOf(matchers.Prefix("ba"), matchers.Not(matchers.Suffix("z")))).
+			Return("foobar", nil)
+	})
+	val, _ := MultipleReturnValuesNoReceiver("bar")
+	c.Assert(val, Equals, "foobar")
+	val, _ = MultipleReturnValuesNoReceiver("baz")
+	c.Assert(val, Equals, "baz")
+	Verifying(c, func() {
+		Verify(MultipleReturnValuesNoReceiver("")).WithMatchers(matchers.Any()).Times(2)
+	})
+}
+
+func (suite *Mock4goSuite) TestMismatchReportsIncludeTheDifferences(c *C) {
+	reporter := &fakeReporter{}
+	Strict(reporter)
+	foo := &Foo{Field: "foo"}
+	Mock(func() {
+		StructArgumentsNoReceiver(Foo{Field: "foo"}, map[string]int{"one": 1, "two": 2}, []string{"foo"})
+		When(foo.MultipleReturnValues()).Return("bar", nil)
+	})
+	StructArgumentsNoReceiver(Foo{Field: "bar"}, map[string]int{"one": 1, "two": 3, "three": 3}, []string{"foo", "bar"})
+	(&Foo{Field: "foo"}).MultipleReturnValues()
+	Verifying(reporter, func() {
+		Verify(MultipleReturnValuesNoReceiver("")).WithMatchers(matchers.Prefix("ba")).Never()
+	})
+	MultipleReturnValuesNoReceiver("bar")
+	Verifying(reporter, func() {
+		Verify(MultipleReturnValuesNoReceiver("")).WithMatchers(matchers.Prefix("ba")).Never()
+	})
+	c.Assert(reporter.errors, HasLen, 3)
+	c.Assert(reporter.errors[0], Equals, `unexpected call test.StructArgumentsNoReceiver(test.Foo{Field:"bar"}, map[string]int{"one":1, "three":3, "two":3}, []string{"foo", "bar"})
+registered stubs:
+    test.StructArgumentsNoReceiver(test.Foo{Field:"foo"}, map[string]int{"one":1, "two":2}, []string{"foo"})
+        argument 0: expected test.Foo{Field:"foo"}, got test.Foo{Field:"bar"}
+            .Field: expected "foo", got "bar"
+        argument 1: expected map[string]int{"one":1, "two":2}, got map[string]int{"one":1, "three":3, "two":3}
+            ["three"]: unexpected 3
+            ["two"]: expected 2, got 3
+        argument 2: expected []string{"foo"}, got []string{"foo", "bar"}
+            value: expected length 1, got 2`)
+	c.Assert(reporter.errors[1], Matches, `unexpected call test.\(\*Foo\).MultipleReturnValues\(&test.Foo{Field:"foo"}\)
+registered stubs:
+    test.\(\*Foo\).MultipleReturnValues\(&test.Foo{Field:"foo"}\)
+        receiver: expected &test.Foo{Field:"foo"}, got &test.Foo{Field:"foo"}`)
+	c.Assert(reporter.errors[2], Equals, `expected test.MultipleReturnValuesNoReceiver(Prefix("ba")) to be called exactly 0 times, but it was called 1 time
+actual calls:
+    test.MultipleReturnValuesNoReceiver("bar")`)
+}
+
+func (suite *Mock4goSuite) TestCapturingArguments(c *C) {
+	captor := NewCaptor()
+	Mock(func() {
+		When(MultipleReturnValuesNoReceiver("")).WithMatchers(captor).Return("bar", nil)
+	})
+	MultipleReturnValuesNoReceiver("foo")
+	MultipleReturnValuesNoReceiver("baz")
+	c.Assert(captor.Last(), Equals, "baz")
+	c.Assert(captor.All(), DeepEquals, []interface{}{"foo", "baz"})
+}
+
+func (suite *Mock4goSuite) TestCapturingArgumentsOfMatchingCallsOnly(c *C) {
+	captor := NewCaptor()
+	c.Assert(captor.Last(), IsNil)
+	Mock(func() {
+		StructArgumentsNoReceiver(Foo{}, nil, nil)
+	})
+	StructArgumentsNoReceiver(Foo{Field: "foo"}, nil, []string{"foo"})
+	StructArgumentsNoReceiver(Foo{Field: "bar"}, nil, []string{"bar"})
+	Verifying(c, func() {
+		StructArgumentsNoReceiver(Foo{}, nil, nil)
+		Verify().WithMatchers(captor, matchers.Any(), matchers.Eq([]string{"bar"})).
+			Once()
+	})
+	c.Assert(captor.All(), DeepEquals, []interface{}{Foo{Field: "bar"}})
+}
+
+func (suite *Mock4goSuite) TestVerifyingCallsInOrder(c *C) {
+	mock := &MockTestInterface{}
+	Mock(func() {
+		When(mock.Value()).Return("foo")
+	})
+	MultipleReturnValuesNoReceiver("open")
+	mock.Value()
+	NoReturnValuesNoReceiver("write")
+	MultipleReturnValuesNoReceiver("close")
+	Verifying(c, func() {
+		c.Assert(InOrder(c,
+			Verify(MultipleReturnValuesNoReceiver("open")),
+			Verify(mock.Value()),
+			Verify(MultipleReturnValuesNoReceiver("close")),
+		), Equals, true)
+		NoReturnValuesNoReceiver("")
+		write := Verify().AnyArguments()
+		c.Assert(InOrder(c,
+			Verify(MultipleReturnValuesNoReceiver("open")),
+			write,
+		), Equals, true)
+	})
+}
+
+func (suite *Mock4goSuite) TestVerifyingCallsInOrderFailure(c *C) {
+	MultipleReturnValuesNoReceiver("open")
+	MultipleReturnValuesNoReceiver("close")
+	NoReturnValuesNoReceiver("write")
+	reporter := &fakeReporter{}
+	Verifying(c, func() {
+		MultipleReturnValuesNoReceiver("open")
+		open := Verify()
+		NoReturnValuesNoReceiver("write")
+		write := Verify()
+		MultipleReturnValuesNoReceiver("close")
+		c.Assert(InOrder(reporter, open, write, Verify()), Equals, false)
+	})
+	c.Assert(reporter.errors, HasLen, 1)
+	c.Assert(reporter.errors[0], Equals, `expected calls in order:
+    test.MultipleReturnValuesNoReceiver("open")
+    test.NoReturnValuesNoReceiver("write")
+    test.MultipleReturnValuesNoReceiver("close")
+but test.MultipleReturnValuesNoReceiver("close") wasn't called after test.NoReturnValuesNoReceiver("write")
+actual calls:
+    test.MultipleReturnValuesNoReceiver("open")
+    test.MultipleReturnValuesNoReceiver("close")
+    test.NoReturnValuesNoReceiver("write")`)
+}
+
+func (suite *Mock4goSuite) TestStubbingVariadicFunctions(c *C) {
+	Mock(func() {
+		When(VariadicNoReceiver("x", "foo")).Return("one")
+		When(VariadicNoReceiver("x", "foo", "bar")).Return("two")
+		When(VariadicNoReceiver("", "")).WithMatchers(matchers.Eq("n"), matchers.Gt(10)).Return("big")
+	})
+	c.Assert(VariadicNoReceiver("x", "foo"), Equals, "one")
+	c.Assert(VariadicNoReceiver("x", "foo", "bar"), Equals, "two")
+	c.Assert(VariadicNoReceiver("x", "foo", "bar", "baz"), Equals, "xfoobarbaz")
+	c.Assert(VariadicNoReceiver("n", 11), Equals, "big")
+	c.Assert(VariadicNoReceiver("n", 1), Equals, "n1")
+	c.Assert(LastCall(VariadicNoReceiver).Args, DeepEquals, []interface{}{"n", []interface{}{1}})
+}
+
+func (suite *Mock4goSuite) TestMatchingAllTheVariadicArguments(c *C) {
+	mock := &MockTestVariadicInterface{}
+	Mock(func() {
+		When(mock.Join("", "")).WithMatchers(matchers.Any(), matchers.Any(), Variadic(matchers.Len(2))).Return("two")
+		When(mock.Join("", "")).WithMatchers(matchers.Any(), matchers.Any(), Variadic(matchers.Any())).Return("any")
+	})
+	c.Assert(mock.Join(",", "foo", "bar"), Equals, "two")
+	c.Assert(mock.Join(","), Equals, "any")
+	c.Assert(mock.Join(",", "foo", "bar", "baz"), Equals, "any")
+	Verifying(c, func() {
+		Verify(mock.Join(",", "foo", "bar")).Once()
+		Verify(mock.Join("", "")).WithMatchers(matchers.Any(), matchers.Any(), Variadic(matchers.Len(3))).Once()
+	})
+}
+
+func (suite *Mock4goSuite) TestVariadicAnswers(c *C) {
+	Mock(func() {
+		When(VariadicNoReceiver("", "")).
+			WithMatchers(matchers.Any(), Variadic(matchers.Any())).
+			Do(func(prefix string, args ...interface{}) string {
+				return fmt.Sprintf("%s %d", prefix, len(args))
+			})
+	})
+	c.Assert(VariadicNoReceiver("foo", 1, 2), Equals, "foo 2")
+	c.Assert(VariadicNoReceiver("bar"), Equals, "bar 0")
+}
+
+func (suite *Mock4goSuite) TestStubbingUnnamedAndBlankParameters(c *C) {
+	Mock(func() {
+		When(UnnamedParametersNoReceiver("foo", 1)).Return("foo")
+		When(BlankParametersNoReceiver("foo", 1, "bar")).Return("foo")
+	})
+	c.Assert(UnnamedParametersNoReceiver("foo", 1), Equals, "foo")
+	c.Assert(UnnamedParametersNoReceiver("foo", 2), Equals, "unnamed")
+	c.Assert(BlankParametersNoReceiver("foo", 1, "bar"), Equals, "foo")
+	c.Assert(BlankParametersNoReceiver("bar", 1, "bar"), Equals, "blank")
+	c.Assert(BlankParametersNoReceiver("foo", 1), Equals, "blank")
+	c.Assert(LastCall(UnnamedParametersNoReceiver).Args, DeepEquals, []interface{}{"foo", 2})
+}
+
+func (suite *Mock4goSuite) TestMockingUnnamedParametersOfInterfaces(c *C) {
+	mock := &MockTestNoArgNameInterface{}
+	Mock(func() {
+		When(mock.Value("foo")).Return("bar")
+	})
+	c.Assert(mock.Value("baz"), Equals, "")
+	c.Assert(LastCall((*MockTestNoArgNameInterface).Value).Args, DeepEquals, []interface{}{"baz"})
+}
+
+func (suite *Mock4goSuite) TestStubbingUnnamedReceivers(c *C) {
+	foo := Foo{Field: "foo"}
+	Mock(func() {
+		When(foo.UnnamedReceiver()).Return("foo")
+	})
+	c.Assert(foo.UnnamedReceiver(), Equals, "foo")
+	c.Assert(Foo{}.UnnamedReceiver(), Equals, "unnamed")
+}
+
+func (suite *Mock4goSuite) TestStubbingGroupedAndNamedResults(c *C) {
+	value, err := NakedReturnNoReceiver()
+	c.Assert(value, Equals, "naked")
+	c.Assert(err, IsNil)
+	Mock(func() {
+		When(GroupedResultsNoReceiver()).Return(3, 4)
+		When(NakedReturnNoReceiver()).Return("", errors.New("stubbed"))
+	})
+	first, second := GroupedResultsNoReceiver()
+	c.Assert(first, Equals, 3)
+	c.Assert(second, Equals, 4)
+	value, err = NakedReturnNoReceiver()
+	c.Assert(value, Equals, "")
+	c.Assert(err, ErrorMatches, "stubbed")
+}
+
+func (suite *Mock4goSuite) TestStubbingFunctionsThatShadowTheGeneratedNames(c *C) {
+	Mock(func() {
+		When(ShadowingNoReceiver("foo", "bar", nil)).Return("stubbed", nil)
+	})
+	value, err := ShadowingNoReceiver("foo", "bar", nil)
+	c.Assert(value, Equals, "stubbed")
+	c.Assert(err, IsNil)
+	value, _ = ShadowingNoReceiver("bar", "baz", nil)
+	c.Assert(value, Equals, "barbaz")
+}
+
+func (suite *Mock4goSuite) TestStubbingGenericFunctions(c *C) {
+	Mock(func() {
+		When(FirstNoReceiver([]int{1, 2})).Return(3)
+		When(FirstNoReceiver([]string{"foo"})).Return("bar")
+	})
+	c.Assert(FirstNoReceiver([]int{1, 2}), Equals, 3)
+	c.Assert(FirstNoReceiver([]int{2, 1}), Equals, 2)
+	c.Assert(FirstNoReceiver([]string{"foo"}), Equals, "bar")
+	c.Assert(FirstNoReceiver([]*Foo{nil}), IsNil)
+	c.Assert(Calls(FirstNoReceiver[int]), HasLen, 2)
+	c.Assert(Calls(FirstNoReceiver[string]), HasLen, 1)
+	c.Assert(LastCall(FirstNoReceiver[string]).String(), Equals, `test.FirstNoReceiver[...]([]string{"foo"})`)
+}
+
+func (suite *Mock4goSuite) TestStubbingMethodsOfGenericTypes(c *C) {
+	stack := &Stack[int]{}
+	Mock(func() {
+		stack.Push(1)
+		When(stack.Peek()).Return(5)
+	})
+	stack.Push(1)
+	stack.Push(2)
+	c.Assert(stack.Peek(), Equals, 5)
+	Verifying(c, func() {
+		stack.Push(2)
+		Verify().Once()
+	})
+	c.Assert(stack.items, DeepEquals, []int{2})
+}
+
+func (suite *Mock4goSuite) TestMockingGenericInterfaces(c *C) {
+	mock := &MockTestGenericInterface[string, int]{}
+	var _ TestGenericInterface[string, int] = mock
+	Mock(func() {
+		When(mock.Get("foo")).Return(1, true)
+	})
+	value, ok := mock.Get("foo")
+	c.Assert(value, Equals, 1)
+	c.Assert(ok, Equals, true)
+	value, ok = mock.Get("bar")
+	c.Assert(value, Equals, 0)
+	c.Assert(ok, Equals, false)
+}
+
+func sourceLine(c *C, file string, line int) string {
+	content, err := os.ReadFile(file)
+	c.Assert(err, IsNil)
+	lines := strings.Split(string(content), "\n")
+	c.Assert(line > 0 && line <= len(lines), Equals, true)
+	return lines[line-1]
+}
+
+func (suite *Mock4goSuite) TestPositionsPointToTheOriginalSource(c *C) {
+	file, line := CallerNoReceiver()
+	c.Assert(sourceLine(c, file, line), Matches, `.*runtime\.Caller\(0\).*`)
+	_, file, line, _ = runtime.Caller(0)
+	c.Assert(sourceLine(c, file, line), Matches, `.*runtime\.Caller\(0\).*`)
+}
@@ -0,0 +1,304 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	. "github.com/jvshahid/mock4go"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestScopes(t *testing.T) {
+	for i := 0; i < 5; i++ {
+		value := fmt.Sprintf("bar%d", i)
+		t.Run(value, func(t *testing.T) {
+			t.Parallel()
+			ctrl := NewScope(t)
+			ctrl.Mock(func() {
+				When(OneReturnValueNoReceiver()).Return(value)
+			})
+
+			var wg sync.WaitGroup
+			for j := 0; j < 10; j++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					// goroutines created by goroutines created by the test
+					// belong to the scope too
+					done := make(chan struct{})
+					go func() {
+						defer close(done)
+						if actual := OneReturnValueNoReceiver(); actual != value {
+							t.Errorf("expected %s but got %s", value, actual)
+						}
+					}()
+					<-done
+				}()
+			}
+			wg.Wait()
+
+			if actual := OneReturnValueNoReceiver(); actual != value {
+				t.Errorf("expected %s but got %s", value, actual)
+			}
+			// ResetMocks doesn't affect the scope
+			ResetMocks()
+			if actual := OneReturnValueNoReceiver(); actual != value {
+				t.Errorf("expected %s but got %s", value, actual)
+			}
+			ctrl.Verifying(func() {
+				Verify(OneReturnValueNoReceiver()).Times(12)
+			})
+			if calls := Calls(OneReturnValueNoReceiver); len(calls) != 0 {
+				t.Errorf("expected the scoped calls to be recorded in the scope, got %v", calls)
+			}
+		})
+	}
+}
+
+func TestScopesIncludeGoroutinesWhoseParentExited(t *testing.T) {
+	ctrl := NewScope(t)
+	ctrl.Mock(func() {
+		When(OneReturnValueNoReceiver()).Return("bar")
+	})
+
+	start := make(chan struct{})
+	result := make(chan string)
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		go func() {
+			<-start
+			result <- OneReturnValueNoReceiver()
+		}()
+	}()
+	// the worker calls the function after the goroutine that created it
+	// exited
+	<-exited
+	close(start)
+	if actual := <-result; actual != "bar" {
+		t.Errorf("expected bar but got %s", actual)
+	}
+}
+
+func TestScopesAreRemovedWhenTheTestFinishes(t *testing.T) {
+	t.Run("scoped", func(t *testing.T) {
+		ctrl := NewScope(t)
+		ctrl.Mock(func() {
+			When(OneReturnValueNoReceiver()).Return("bar")
+		})
+		if actual := OneReturnValueNoReceiver(); actual != "bar" {
+			t.Errorf("expected bar but got %s", actual)
+		}
+	})
+	if actual := OneReturnValueNoReceiver(); actual != "foo" {
+		t.Errorf("expected foo but got %s", actual)
+	}
+	ResetMocks()
+}
+
+func TestScopesIncludeGoroutinesThatReplaceTheirLabels(t *testing.T) {
+	ctrl := NewScope(t)
+	ctrl.Mock(func() {
+		When(OneReturnValueNoReceiver()).Return("bar")
+	})
+
+	results := make(chan string, 2)
+	go pprof.Do(ctrl.Context(context.Background()), pprof.Labels("worker", "scoped"), func(context.Context) {
+		results <- OneReturnValueNoReceiver()
+	})
+	if actual := <-results; actual != "bar" {
+		t.Errorf("expected bar but got %s", actual)
+	}
+	// the labels don't have the scope
+	go pprof.Do(context.Background(), pprof.Labels("worker", "unscoped"), func(context.Context) {
+		results <- OneReturnValueNoReceiver()
+	})
+	if actual := <-results; actual != "foo" {
+		t.Errorf("expected foo but got %s", actual)
+	}
+}
+
+func TestScopesKeepTheLabelsOfTheTest(t *testing.T) {
+	pprof.Do(context.Background(), pprof.Labels("test", "labels"), func(context.Context) {
+		tb := &cleanupTB{TB: t}
+		NewScope(tb)
+		if labels := testLabels(t); !strings.Contains(labels, `"mock4go.scope":`) || !strings.Contains(labels, `"test":"labels"`) {
+			t.Errorf("expected the scope to be added to the labels of the test, got %s", labels)
+		}
+		tb.cleanup()
+		if labels := testLabels(t); labels != `{"test":"labels"}` {
+			t.Errorf("expected the labels of the test to be restored, got %s", labels)
+		}
+	})
+}
+
+// Returns the profiler labels of the goroutine running
+// TestScopesKeepTheLabelsOfTheTest
+func testLabels(t *testing.T) string {
+	buf := bytes.NewBuffer(nil)
+	if err := pprof.Lookup("goroutine").WriteTo(buf, 1); err != nil {
+		t.Fatal(err)
+	}
+	for _, goroutine := range strings.Split(buf.String(), "\n\n") {
+		if !strings.Contains(goroutine, ".TestScopesKeepTheLabelsOfTheTest") {
+			continue
+		}
+		for _, line := range strings.Split(goroutine, "\n") {
+			if strings.HasPrefix(line, "# labels: ") {
+				return strings.TrimPrefix(line, "# labels: ")
+			}
+		}
+		return ""
+	}
+	t.Fatal("the goroutine of the test wasn't found")
+	return ""
+}
+
+// runs the cleanup functions when the test calls cleanup
+type cleanupTB struct {
+	testing.TB
+	cleanups []func()
+}
+
+func (c *cleanupTB) Cleanup(fun func()) {
+	c.cleanups = append(c.cleanups, fun)
+}
+
+func (c *cleanupTB) cleanup() {
+	for i := len(c.cleanups) - 1; i >= 0; i-- {
+		c.cleanups[i]()
+	}
+}
+
+type fakeTB struct {
+	testing.TB
+	errors []string
+}
+
+func (f *fakeTB) Errorf(format string, args ...interface{}) {
+	f.errors = append(f.errors, fmt.Sprintf(format, args...))
+}
+
+func TestMockTRemovesTheStubsWhenTheTestFinishes(t *testing.T) {
+	Mock(func() {
+		When(MultipleReturnValuesNoReceiver("foo")).Return("bar", nil)
+	})
+	defer ResetMocks()
+
+	t.Run("stubbed", func(t *testing.T) {
+		MockT(t, func() {
+			When(OneReturnValueNoReceiver()).Return("bar")
+			When(MultipleReturnValuesNoReceiver("bar")).Return("baz", nil)
+		})
+		if actual := OneReturnValueNoReceiver(); actual != "bar" {
+			t.Errorf("expected bar but got %s", actual)
+		}
+		if actual, _ := MultipleReturnValuesNoReceiver("bar"); actual != "baz" {
+			t.Errorf("expected baz but got %s", actual)
+		}
+	})
+
+	if actual := OneReturnValueNoReceiver(); actual != "foo" {
+		t.Errorf("expected foo but got %s", actual)
+	}
+	if actual, _ := MultipleReturnValuesNoReceiver("bar"); actual != "bar" {
+		t.Errorf("expected bar but got %s", actual)
+	}
+	// stubs created outside MockT aren't removed
+	if actual, _ := MultipleReturnValuesNoReceiver("foo"); actual != "bar" {
+		t.Errorf("expected bar but got %s", actual)
+	}
+}
+
+func TestMockTRemovesTheCallsAndTheStrictModeWhenTheTestFinishes(t *testing.T) {
+	ResetMocks()
+	defer ResetMocks()
+	// strict mode only reports the calls to stubbed functions
+	Mock(func() {
+		When(MultipleReturnValuesNoReceiver("bar")).Return("baz", nil)
+	})
+	OneReturnValueNoReceiver()
+
+	var tb *fakeTB
+	t.Run("strict", func(t *testing.T) {
+		tb = &fakeTB{TB: t}
+		MockT(tb, func() {
+			When(OneReturnValueNoReceiver()).Return("bar")
+		})
+		Strict(tb)
+		OneReturnValueNoReceiver()
+		MultipleReturnValuesNoReceiver("foo")
+		if calls := Calls(OneReturnValueNoReceiver); len(calls) != 2 {
+			t.Errorf("expected 2 calls but got %v", calls)
+		}
+	})
+
+	// calls made before MockT aren't removed
+	if calls := Calls(OneReturnValueNoReceiver); len(calls) != 1 {
+		t.Errorf("expected 1 call but got %v", calls)
+	}
+	if calls := Calls(MultipleReturnValuesNoReceiver); len(calls) != 0 {
+		t.Errorf("expected no calls but got %v", calls)
+	}
+	MultipleReturnValuesNoReceiver("foo")
+	if len(tb.errors) != 1 {
+		t.Errorf("expected only the call made during the test to be reported, got %v", tb.errors)
+	}
+}
+
+func TestMockTReportsStubbingErrors(t *testing.T) {
+	tb := &fakeTB{TB: t}
+	MockT(tb, func() {
+		When(OneReturnValueNoReceiver()).Do(func() int { return 0 })
+		When(OneReturnValueNoReceiver()).ReturnError(fmt.Errorf("foo"))
+		When(OneReturnValueNoReceiver()).Return("bar").ProcessResults(nil)
+	})
+	expected := []string{
+		"Do: expected a function of type func() string but got func() int",
+		"ReturnError: test.OneReturnValueNoReceiver doesn't return an error",
+		"ProcessResults: test.OneReturnValueNoReceiver doesn't call the real implementation",
+	}
+	if fmt.Sprint(tb.errors) != fmt.Sprint(expected) {
+		t.Errorf("expected %v but got %v", expected, tb.errors)
+	}
+}
+
+// test files aren't instrumented
+func notInstrumented() string {
+	return "foo"
+}
+
+func TestMockTReportsWhenWithoutAnInstrumentedCall(t *testing.T) {
+	tb := &fakeTB{TB: t}
+	MockT(tb, func() {
+		When(OneReturnValueNoReceiver()).Return("bar")
+		When(notInstrumented()).Return("baz")
+	})
+	if len(tb.errors) != 1 || !strings.HasSuffix(tb.errors[0], ": When: no instrumented call recorded") {
+		t.Errorf("expected the missing call to be reported but got %v", tb.errors)
+	}
+	// the previous stub isn't changed
+	if actual := OneReturnValueNoReceiver(); actual != "bar" {
+		t.Errorf("expected bar but got %s", actual)
+	}
+}
+
+func TestMockTRemovesTheSpiesWhenTheTestFinishes(t *testing.T) {
+	defer ResetMocks()
+	t.Run("spied", func(t *testing.T) {
+		MockT(t, func() {
+			Spy(OneReturnValueNoReceiver)
+		})
+		OneReturnValueNoReceiver()
+		if returned := LastCall(OneReturnValueNoReceiver).RealReturned; len(returned) != 1 {
+			t.Errorf("expected the call to be spied on, got %v", returned)
+		}
+	})
+	OneReturnValueNoReceiver()
+	if returned := LastCall(OneReturnValueNoReceiver).RealReturned; returned != nil {
+		t.Errorf("expected the spy to be removed, got %v", returned)
+	}
+}
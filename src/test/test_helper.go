@@ -2,6 +2,7 @@ package test
 
 import (
 	"fmt"
+	"runtime"
 )
 
 type TestInterface interface {
@@ -73,3 +74,99 @@ func OneReturnValueNoReceiver2() string {
 func MultipleReturnValuesNoReceiver(value string) (string, error) {
 	return value, nil
 }
+
+func PanicsNoReceiver(value string) string {
+	panic(value)
+}
+
+func WideReturnValuesNoReceiver() (string, int, *Foo, error) {
+	return "foo", 1, &Foo{}, nil
+}
+
+type Names []string
+
+func TypedReturnValuesNoReceiver() (int64, float32, Names, fmt.Stringer, *Foo) {
+	return 0, 0, nil, nil, nil
+}
+
+func StructArgumentsNoReceiver(foo Foo, values map[string]int, names []string) {
+}
+
+func VariadicNoReceiver(prefix string, args ...interface{}) string {
+	return prefix + fmt.Sprint(args...)
+}
+
+type TestVariadicInterface interface {
+	Join(separator string, values ...string) string
+}
+
+func UnnamedParametersNoReceiver(string, int) string {
+	return "unnamed"
+}
+
+func BlankParametersNoReceiver(_ string, value int, _ ...string) string {
+	return "blank"
+}
+
+func (Foo) UnnamedReceiver() string {
+	return "unnamed"
+}
+
+func GroupedResultsNoReceiver() (first, second int) {
+	return 1, 2
+}
+
+func NakedReturnNoReceiver() (value string, err error) {
+	value = "naked"
+	return
+}
+
+func ShadowingNoReceiver(values, ok string, err error) (mock4go string, err2 error) {
+	return values + ok, err
+}
+
+func FirstNoReceiver[T any](values []T) T {
+	return values[0]
+}
+
+type Stack[T any] struct {
+	items []T
+}
+
+func (s *Stack[T]) Push(value T) {
+	s.items = append(s.items, value)
+}
+
+func (s *Stack[T]) Peek() T {
+	return s.items[len(s.items)-1]
+}
+
+type TestGenericInterface[K comparable, V any] interface {
+	Get(key K) (V, bool)
+}
+
+type TestConstraint interface {
+	~int | ~string
+}
+
+// Returns the position of the call to runtime.Caller, the instrumented
+// code must point to the original source
+func CallerNoReceiver() (string, int) {
+	_, file, line, _ := runtime.Caller(0)
+	return file, line
+}
+
+// A matcher declared in an instrumented file, its methods are instrumented
+// too and call into mock4go while it builds the failure messages
+type LengthMatcher struct {
+	Length int
+}
+
+func (m *LengthMatcher) Matches(value interface{}) bool {
+	s, ok := value.(string)
+	return ok && len(s) == m.Length
+}
+
+func (m *LengthMatcher) Describe() string {
+	return fmt.Sprintf("a string of length %d", m.Length)
+}
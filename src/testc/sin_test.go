@@ -1,6 +1,7 @@
 package testc
 
 import (
+	. "github.com/jvshahid/mock4go"
 	. "launchpad.net/gocheck"
 	"testing"
 )
@@ -19,3 +20,11 @@ var _ = Suite(&Mock4goSuite{})
 func (suite *Mock4goSuite) TestSing(c *C) {
 	c.Assert(Sin(0.0), Equals, 0.0)
 }
+
+func (suite *Mock4goSuite) TestStubbingFunctionsThatCallC(c *C) {
+	Mock(func() {
+		When(Sin(0.0)).Return(1.0)
+	})
+	defer ResetMocks()
+	c.Assert(Sin(0.0), Equals, 1.0)
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Report calls to stubbed functions that don't match any stub instead of
+// calling the real implementation, the unmatched calls return the zero
+// values. If no functions are given, strict mode applies to all the
+// functions. Strict mode is disabled by ResetMocks.
+func Strict(reporter TestReporter, funs ...function) {
+	global.strict(reporter, funs)
+}
+
+func (r *registry) strict(reporter TestReporter, funs []function) {
+	lock.Lock()
+	defer lock.Unlock()
+	if len(funs) == 0 {
+		r.strictReporter = reporter
+		return
+	}
+	for _, fun := range funs {
+		r.strictFunctions[getFunType(fun)] = reporter
+	}
+}
+
+// disable strict mode where it reports to the given reporter, must be
+// called while holding the lock
+func (r *registry) removeStrict(reporter TestReporter) {
+	if r.strictReporter == reporter {
+		r.strictReporter = nil
+	}
+	for funType, functionReporter := range r.strictFunctions {
+		if functionReporter == reporter {
+			delete(r.strictFunctions, funType)
+		}
+	}
+}
+
+// must be called while holding the lock
+func (r *registry) strictReporterFor(funType interface{}) TestReporter {
+	if reporter := r.strictFunctions[funType]; reporter != nil {
+		return reporter
+	}
+	return r.strictReporter
+}
+
+// Returns the reporter and the failure message if the call should be
+// reported, must be called without holding the lock
+func (r *registry) unmatchedCall(funType interface{}, call *Call) (TestReporter, string) {
+	lock.Lock()
+	reporter := r.strictReporterFor(funType)
+	stubs := append([]*functionCall{}, r.stubs[funType]...)
+	exhausted := make([]string, 0, len(stubs))
+	matchers := make([][]Matcher, 0, len(stubs))
+	for _, stub := range stubs {
+		suffix := ""
+		if stub.exhausted() {
+			suffix = fmt.Sprintf(" (exhausted after %s)", times(stub.used))
+		}
+		exhausted = append(exhausted, suffix)
+		matchers = append(matchers, stub.args)
+	}
+	lock.Unlock()
+
+	if reporter == nil {
+		return nil, ""
+	}
+	// the matchers are described and called without holding the lock
+	lines := make([]string, 0)
+	for idx, stub := range stubs {
+		lines = append(lines, "    "+stub.String()+exhausted[idx])
+		for _, line := range explainMismatches(matchers[idx], call) {
+			lines = append(lines, "        "+line)
+		}
+	}
+	return reporter, fmt.Sprintf("unexpected call %s\nregistered stubs:\n%s", call, strings.Join(lines, "\n"))
+}
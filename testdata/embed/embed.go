@@ -0,0 +1,13 @@
+package embedded
+
+import _ "embed"
+
+//go:embed greeting.txt
+var greeting string
+
+//go:embed static/*.html
+var index string
+
+func Greeting() string {
+	return greeting
+}
@@ -0,0 +1,19 @@
+package embedded
+
+import (
+	"embed"
+	"testing"
+)
+
+//go:embed all:expected
+var expected embed.FS
+
+func TestGreeting(t *testing.T) {
+	content, err := expected.ReadFile("expected/greeting.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Greeting() != string(content) {
+		t.Errorf("expected %q but got %q", content, Greeting())
+	}
+}
@@ -0,0 +1,39 @@
+//go:build linux || darwin
+// +build linux darwin
+
+// Package directives has comments that change how it builds.
+package directives
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	_ "embed"
+	_ "unsafe"
+)
+
+//go:embed directives.go
+var source string
+
+//go:linkname nanotime runtime.nanotime
+func nanotime() int64
+
+// Abs returns the absolute value of x in C.
+//
+//go:noinline
+func Abs(x int) int {
+	// cgo call
+	return int(C.abs(C.int(x)))
+}
+
+//export Exported
+func Exported(x C.int) C.int {
+	return x // the argument
+}
+
+// Source returns the content of this file.
+func Source() string {
+	return source
+}
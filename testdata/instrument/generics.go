@@ -0,0 +1,40 @@
+package generics
+
+type Number interface {
+	~int | ~float64
+}
+
+type Ordered interface {
+	Number
+	String() string
+}
+
+type Store[K comparable, V any] interface {
+	Get(key K) (V, bool)
+}
+
+type NamedStore[V any] interface {
+	Store[string, V]
+	Name() string
+}
+
+type List[T any] struct {
+	items []T
+}
+
+func (l *List[T]) Push(value T) {
+	l.items = append(l.items, value)
+}
+
+func (l *List[_]) Len() int {
+	return 0
+}
+
+func Map[T, U any](values []T, f func(T) U) []U {
+	return nil
+}
+
+func Sum[T Number](values ...T) T {
+	var sum T
+	return sum
+}
@@ -0,0 +1,31 @@
+package hygiene
+
+type values int
+
+type ok struct{}
+
+type MockClash struct{}
+
+type Clash interface {
+	Value() string
+}
+
+type Shadowing interface {
+	Value(arg0, recv string) (values, ok)
+}
+
+func Params(values, ok string, err error) string {
+	return values
+}
+
+func Results() (values, ok) {
+	return 0, ok{}
+}
+
+func Import(mock4go string) {
+}
+
+func Unnamed(string) {
+	arg0 := 1
+	_ = arg0
+}
@@ -0,0 +1,7 @@
+package multifile
+
+var mock4go = "declared in another file"
+
+func MockThing2() Thing2 {
+	return nil
+}
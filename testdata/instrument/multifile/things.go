@@ -0,0 +1,13 @@
+package multifile
+
+type Thing interface {
+	Value() string
+}
+
+type Thing2 interface {
+	Value() string
+}
+
+func Describe(thing Thing) string {
+	return "thing: " + thing.Value()
+}
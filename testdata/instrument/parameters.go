@@ -0,0 +1,10 @@
+package parameters
+
+func Unnamed(string, int) {
+}
+
+func Blank(_ string, value int) {
+}
+
+func Variadic(format string, args ...interface{}) {
+}
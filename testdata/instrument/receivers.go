@@ -0,0 +1,14 @@
+package receivers
+
+type Foo struct{}
+
+func (f *Foo) Named() string {
+	return "named"
+}
+
+func (Foo) Unnamed() string {
+	return "unnamed"
+}
+
+func (_ *Foo) Blank() {
+}
@@ -0,0 +1,18 @@
+package results
+
+func Single() int {
+	return 1
+}
+
+func Grouped() (a, b int) {
+	return 1, 2
+}
+
+func Mixed() (a, b int, err error) {
+	return 1, 2, nil
+}
+
+func Naked() (value string, err error) {
+	value = "naked"
+	return
+}
@@ -0,0 +1,21 @@
+package shadowing
+
+import "net/url"
+
+// url shadows the package in the body, the generated code refers to
+// url.URL
+func Parse(url string) (*url.URL, error) {
+	return nil, nil
+}
+
+type Buffer struct{}
+
+// the receiver and the parameter shadow the types of the signature
+func (Buffer *Buffer) Grow(string string) string {
+	return string
+}
+
+// variadic parameters are renamed too
+func Join(url ...*url.URL) []*url.URL {
+	return url
+}
@@ -0,0 +1,5 @@
+package lib
+
+func Greeting() string {
+	return "Hello"
+}
@@ -0,0 +1,11 @@
+package greet
+
+import "example.com/lib"
+
+func Greeting() string {
+	return lib.Greeting()
+}
+
+func Hello(name string) string {
+	return Greeting() + ", " + name
+}
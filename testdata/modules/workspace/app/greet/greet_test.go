@@ -0,0 +1,18 @@
+package greet
+
+import (
+	. "github.com/jvshahid/mock4go"
+	"testing"
+)
+
+func TestHello(t *testing.T) {
+	if actual := Hello("John"); actual != "Hello, John" {
+		t.Errorf("expected Hello, John but got %s", actual)
+	}
+	MockT(t, func() {
+		When(Greeting()).Return("Hi")
+	})
+	if actual := Hello("John"); actual != "Hi, John" {
+		t.Errorf("expected Hi, John but got %s", actual)
+	}
+}
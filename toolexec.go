@@ -0,0 +1,609 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"go/build"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Returns the arguments to run the given tool with when mock4go is used
+// with go build -toolexec, e.g.
+//
+//	go test -toolexec=mock4go ./...
+//
+// The Go files given to compile are instrumented and replaced by the
+// instrumented copies, the packages in GOROOT, in the module cache and in
+// vendor directories are left alone. The runtime package is added to the
+// import config of compile and link so the instrumented code can import
+// it even if the package, or the binary, doesn't depend on it. vet checks
+// the instrumented files too, since the tests can use the generated mocks
+func ToolexecArgs(tool string, args []string) ([]string, error) {
+	if os.Getenv(nestedToolexec) != "" {
+		return args, nil
+	}
+	switch strings.TrimSuffix(filepath.Base(tool), ".exe") {
+	case "compile":
+		return withResponseFiles(args, compileArgs)
+	case "link":
+		return withResponseFiles(args, linkArgs)
+	case "vet":
+		return vetArgs(args)
+	}
+	return args, nil
+}
+
+// Returns the output of tool -V=full with the version of the runtime
+// package and of mock4go appended to it. The go command uses it to compute
+// the keys of the build cache, i.e. the instrumented packages are built
+// again when mock4go changes
+func ToolVersion(version string) (string, error) {
+	if os.Getenv(nestedToolexec) != "" {
+		return version, nil
+	}
+	packages, err := runtimePackages("", buildFlags(nil))
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	// the files are named after the hash of their content
+	io.WriteString(hash, strings.Join(packages, "\n"))
+	executable, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	file, err := os.Open(executable)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s mock4go:%x\n", strings.TrimSpace(version), hash.Sum(nil)[:8]), nil
+}
+
+// Instrument the given files of a package to dir. Returns false if the
+// package must not be instrumented
+func instrumentToolFiles(files []string, dir string) (map[string]string, bool, error) {
+	toInstrument := make([]string, 0)
+	for _, file := range files {
+		if isDependency(file) {
+			return nil, false, nil
+		}
+		// the files generated by the go command, e.g. _testmain.go or
+		// _cgo_gotypes.go, start with an underscore
+		if strings.HasPrefix(filepath.Base(file), "_") {
+			continue
+		}
+		toInstrument = append(toInstrument, file)
+	}
+	instrumented, err := InstrumentFiles(toInstrument, dir)
+	return instrumented, err == nil, err
+}
+
+func compileArgs(args []string) ([]string, error) {
+	var pkg, output, importcfg string
+	std := false
+	toolFlags := make([]string, 0)
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-p", "-o", "-importcfg":
+			if i+1 == len(args) {
+				break
+			}
+			switch args[i] {
+			case "-p":
+				pkg = args[i+1]
+			case "-o":
+				output = args[i+1]
+			case "-importcfg":
+				importcfg = args[i+1]
+			}
+			i++
+		case "-std":
+			std = true
+		case "-race", "-msan", "-asan":
+			toolFlags = append(toolFlags, args[i])
+		}
+	}
+	// e.g. compile -V=full, which the go command uses to identify the tool
+	if pkg == "" || output == "" || importcfg == "" || std || SkipInstrumentation(pkg) {
+		return args, nil
+	}
+
+	// the files are the last arguments
+	first := len(args)
+	for first > 0 && strings.HasSuffix(args[first-1], ".go") && !strings.HasPrefix(args[first-1], "-") {
+		first--
+	}
+	files := make([]string, 0)
+	for _, file := range args[first:] {
+		file, err := filepath.Abs(file)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+
+	dir := filepath.Join(filepath.Dir(output), "mock4go")
+	instrumented, ok, err := instrumentToolFiles(files, dir)
+	if err != nil || !ok {
+		return args, err
+	}
+	workDir := filepath.Dir(filepath.Dir(output))
+	cfg, err := addRuntime(importcfg, filepath.Join(dir, "importcfg"), workDir, buildFlags(toolFlags), false)
+	if err != nil {
+		return nil, err
+	}
+
+	newArgs := make([]string, 0, len(args))
+	for i, arg := range args {
+		switch {
+		case i > 0 && args[i-1] == "-importcfg":
+			arg = cfg
+		case i >= first:
+			if file, err := filepath.Abs(arg); err == nil && instrumented[file] != "" {
+				arg = instrumented[file]
+			}
+		}
+		newArgs = append(newArgs, arg)
+	}
+	return newArgs, nil
+}
+
+// The go command passes the arguments in @file response files when they
+// are too long for the command line. The response files are expanded
+// before rewriting the arguments, which are written to a new response
+// file in the directory of the new importcfg, i.e. in the work directory
+// of the go command
+func withResponseFiles(args []string, rewrite func([]string) ([]string, error)) ([]string, error) {
+	expanded, response, err := expandResponseFiles(args)
+	if err != nil {
+		return nil, err
+	}
+	newArgs, err := rewrite(expanded)
+	if err != nil || !response {
+		return newArgs, err
+	}
+	if strings.Join(newArgs, "\x00") == strings.Join(expanded, "\x00") {
+		return args, nil
+	}
+	dir := ""
+	encoded := make([]string, 0, len(newArgs))
+	for i, arg := range newArgs {
+		if i > 0 && newArgs[i-1] == "-importcfg" {
+			dir = filepath.Dir(arg)
+		}
+		encoded = append(encoded, encodeResponseArg(arg))
+	}
+	file, err := os.CreateTemp(dir, "args*.mock4go")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if _, err := io.WriteString(file, strings.Join(encoded, "\n")+"\n"); err != nil {
+		return nil, err
+	}
+	return []string{"@" + file.Name()}, file.Close()
+}
+
+// Returns the arguments with the @file arguments replaced by the content
+// of the files and true if there were any
+func expandResponseFiles(args []string) ([]string, bool, error) {
+	expanded := make([]string, 0, len(args))
+	response := false
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "@") {
+			expanded = append(expanded, arg)
+			continue
+		}
+		content, err := os.ReadFile(arg[1:])
+		if err != nil {
+			return nil, false, err
+		}
+		nested, _, err := expandResponseFiles(parseResponseFile(content))
+		if err != nil {
+			return nil, false, err
+		}
+		expanded = append(expanded, nested...)
+		response = true
+	}
+	return expanded, response, nil
+}
+
+// Split the content of a response file into arguments the way the tools
+// do, i.e. GCC's rules: the arguments are separated by whitespace, single
+// quotes preserve their content, double quotes allow the \\, \", \$ and \`
+// escapes and a backslash escapes the next character outside of quotes.
+// A backslash followed by a newline continues the line
+func parseResponseFile(content []byte) []string {
+	args := make([]string, 0)
+	arg := strings.Builder{}
+	hasArg := false
+	var quote byte
+	for i := 0; i < len(content); i++ {
+		c := content[i]
+		continuation := c == '\\' && i+1 < len(content) &&
+			(content[i+1] == '\n' || content[i+1] == '\r' && i+2 < len(content) && content[i+2] == '\n')
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				arg.WriteByte(c)
+			}
+		case continuation:
+			if content[i+1] == '\r' {
+				i++
+			}
+			i++
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else if c == '\\' && i+1 < len(content) && strings.IndexByte("\\\"$`", content[i+1]) >= 0 {
+				arg.WriteByte(content[i+1])
+				i++
+			} else {
+				arg.WriteByte(c)
+			}
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if arg.Len() > 0 || hasArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				hasArg = false
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			hasArg = true
+		case c == '\\':
+			// a trailing backslash is dropped
+			if i+1 < len(content) {
+				arg.WriteByte(content[i+1])
+				hasArg = true
+				i++
+			}
+		default:
+			arg.WriteByte(c)
+		}
+	}
+	if arg.Len() > 0 || hasArg {
+		args = append(args, arg.String())
+	}
+	return args
+}
+
+// Quote the argument for a response file the way the go command does
+func encodeResponseArg(arg string) string {
+	if arg == "" {
+		return `""`
+	}
+	if !strings.ContainsAny(arg, " \t\n\r'\"\\$`") {
+		return arg
+	}
+	encoded := strings.Builder{}
+	encoded.WriteByte('"')
+	for _, r := range arg {
+		if strings.ContainsRune("\\\"$`", r) {
+			encoded.WriteByte('\\')
+		}
+		encoded.WriteRune(r)
+	}
+	encoded.WriteByte('"')
+	return encoded.String()
+}
+
+func linkArgs(args []string) ([]string, error) {
+	var importcfg string
+	toolFlags := make([]string, 0)
+	for i, arg := range args {
+		switch arg {
+		case "-importcfg":
+			if i+1 < len(args) {
+				importcfg = args[i+1]
+			}
+		case "-race", "-msan", "-asan":
+			toolFlags = append(toolFlags, arg)
+		}
+	}
+	if importcfg == "" {
+		return args, nil
+	}
+
+	workDir := filepath.Dir(filepath.Dir(importcfg))
+	cfg, err := addRuntime(importcfg, importcfg+".mock4go", workDir, buildFlags(toolFlags), true)
+	if err != nil {
+		return nil, err
+	}
+	newArgs := append([]string{}, args...)
+	for i := range newArgs {
+		if i > 0 && newArgs[i-1] == "-importcfg" {
+			newArgs[i] = cfg
+		}
+	}
+	return newArgs, nil
+}
+
+// the fields of the vet config that are used to instrument the package,
+// the config is rewritten as a map to keep the other fields
+type vetConfig struct {
+	ImportPath  string
+	GoFiles     []string
+	ImportMap   map[string]string
+	PackageFile map[string]string
+	VetxOnly    bool
+	VetxOutput  string
+}
+
+func vetArgs(args []string) ([]string, error) {
+	if len(args) == 0 || !strings.HasSuffix(args[len(args)-1], ".cfg") {
+		return args, nil
+	}
+	content, err := os.ReadFile(args[len(args)-1])
+	if err != nil {
+		return nil, err
+	}
+	config := vetConfig{}
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(content, &config); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &fields); err != nil {
+		return nil, err
+	}
+	// the dependencies are only analyzed for facts, there's no need to
+	// instrument them
+	if config.VetxOnly || config.VetxOutput == "" || SkipInstrumentation(config.ImportPath) {
+		return args, nil
+	}
+
+	// compile may be writing to the same directory concurrently
+	dir := filepath.Join(filepath.Dir(config.VetxOutput), "mock4go-vet")
+	instrumented, ok, err := instrumentToolFiles(config.GoFiles, dir)
+	if err != nil || !ok {
+		return args, err
+	}
+	packages, err := runtimePackages(filepath.Dir(filepath.Dir(config.VetxOutput)), buildFlags(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	goFiles := make([]string, 0, len(config.GoFiles))
+	for _, file := range config.GoFiles {
+		if instrumented[file] != "" {
+			file = instrumented[file]
+		}
+		goFiles = append(goFiles, file)
+	}
+	if config.ImportMap == nil {
+		config.ImportMap = make(map[string]string)
+	}
+	if config.PackageFile == nil {
+		config.PackageFile = make(map[string]string)
+	}
+	for _, line := range packages {
+		parts := strings.SplitN(line, "=", 2)
+		if parts[0] == Mock4goImport && config.PackageFile[Mock4goImport] == "" {
+			config.ImportMap[Mock4goImport] = Mock4goImport
+			config.PackageFile[Mock4goImport] = parts[1]
+		}
+	}
+	fields["GoFiles"] = goFiles
+	fields["ImportMap"] = config.ImportMap
+	fields["PackageFile"] = config.PackageFile
+
+	content, err = json.MarshalIndent(fields, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	cfg := filepath.Join(dir, "vet.cfg")
+	if err := os.WriteFile(cfg, content, 0644); err != nil {
+		return nil, err
+	}
+	return append(append([]string{}, args[:len(args)-1]...), cfg), nil
+}
+
+// Returns true if the file belongs to a package that isn't developed in
+// this tree, i.e. a package in the module cache or in a vendor directory
+func isDependency(file string) bool {
+	modCache := os.Getenv("GOMODCACHE")
+	if modCache == "" {
+		modCache = filepath.Join(strings.Split(build.Default.GOPATH, string(filepath.ListSeparator))[0], "pkg", "mod")
+	}
+	if strings.HasPrefix(file, modCache+string(filepath.Separator)) {
+		return true
+	}
+	for _, dir := range strings.Split(filepath.Dir(file), string(filepath.Separator)) {
+		if dir == "vendor" {
+			return true
+		}
+	}
+	return false
+}
+
+// Write the import config in src to dst with the runtime package added
+// to it, and all its dependencies if deps is true, unless they are
+// already there. Returns dst
+func addRuntime(src, dst, workDir string, buildFlags []string, deps bool) (string, error) {
+	content, err := os.ReadFile(src)
+	if err != nil {
+		return "", err
+	}
+	packages, err := runtimePackages(workDir, buildFlags)
+	if err != nil {
+		return "", err
+	}
+
+	cfg := bytes.NewBuffer(content)
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		cfg.WriteString("\n")
+	}
+	for _, line := range packages {
+		importPath := strings.SplitN(line, "=", 2)[0]
+		if !deps && importPath != Mock4goImport {
+			continue
+		}
+		if bytes.Contains(content, []byte("packagefile "+importPath+"=")) {
+			continue
+		}
+		fmt.Fprintf(cfg, "packagefile %s\n", line)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return "", err
+	}
+	return dst, os.WriteFile(dst, cfg.Bytes(), 0644)
+}
+
+// Returns the compiled runtime package and its dependencies as
+// "<import path>=<file>". Unless workDir is empty, the list is saved in
+// workDir, the temporary directory of the go command, so go list runs
+// once per build
+func runtimePackages(workDir string, buildFlags []string) ([]string, error) {
+	// the flags can contain spaces and slashes, e.g. -gcflags=all=-N -l
+	sum := sha256.Sum256([]byte(strings.Join(buildFlags, "\x00")))
+	name := fmt.Sprintf("mock4go-%x.packages", sum[:8])
+	cache := filepath.Join(workDir, name)
+	if workDir != "" {
+		if content, err := os.ReadFile(cache); err == nil {
+			return strings.Fields(string(content)), nil
+		}
+	}
+
+	args := []string{"list", "-export", "-deps", "-f", "{{if .Export}}{{.ImportPath}}={{.Export}}{{end}}"}
+	args = append(args, buildFlags...)
+	cmd := exec.Command("go", append(args, Mock4goImport)...)
+	cmd.Env = nestedEnv(os.Environ())
+	stderr := bytes.NewBufferString("")
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("cannot build %s: %s\n%s", Mock4goImport, err, stderr)
+	}
+
+	if workDir != "" {
+		// compile runs in parallel, write to a temporary file and rename it
+		if tmp, err := os.CreateTemp(workDir, name); err == nil {
+			_, err = tmp.Write(out)
+			tmp.Close()
+			if err == nil {
+				err = os.Rename(tmp.Name(), cache)
+			}
+			if err != nil {
+				os.Remove(tmp.Name())
+			}
+		}
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// set in the environment of the go command that mock4go runs while it's
+// used with -toolexec, the tools it runs aren't instrumented
+const nestedToolexec = "MOCK4GO_TOOLEXEC_NESTED"
+
+// Returns the environment of the go command that builds the runtime
+// package, -toolexec is removed from GOFLAGS, e.g. when an IDE sets
+// GOFLAGS=-toolexec=mock4go, otherwise each tool run by the nested go
+// command would run go list again
+func nestedEnv(environ []string) []string {
+	env := make([]string, 0, len(environ)+1)
+	for _, variable := range environ {
+		if strings.HasPrefix(variable, "GOFLAGS=") {
+			flags := make([]string, 0)
+			for _, flag := range strings.Fields(strings.TrimPrefix(variable, "GOFLAGS=")) {
+				if !strings.HasPrefix(strings.TrimLeft(flag, "-"), "toolexec") {
+					flags = append(flags, flag)
+				}
+			}
+			variable = "GOFLAGS=" + strings.Join(flags, " ")
+		}
+		env = append(env, variable)
+	}
+	return append(env, nestedToolexec+"=1")
+}
+
+// the flags of the go command that change how the packages are compiled,
+// they are passed to the go command that builds the runtime package so it
+// and its dependencies match the packages of the build, e.g. with
+// -gcflags=all=-N -l the link fails otherwise
+var compileFlags = map[string]bool{
+	"asan":          true,
+	"asmflags":      true,
+	"buildmode":     true,
+	"gcflags":       true,
+	"installsuffix": true,
+	"linkshared":    true,
+	"mod":           true,
+	"modfile":       true,
+	"msan":          true,
+	"pgo":           true,
+	"race":          true,
+	"tags":          true,
+	"trimpath":      true,
+}
+
+// the flags of compileFlags that don't take a value
+var boolFlags = map[string]bool{
+	"asan":       true,
+	"linkshared": true,
+	"msan":       true,
+	"race":       true,
+	"trimpath":   true,
+}
+
+// Returns the build flags of the go command that runs mock4go, which is
+// its parent process. Only the flags that the tool is run with, e.g.
+// -race, are known if the command line of the parent can't be read
+func buildFlags(toolFlags []string) []string {
+	content, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", os.Getppid()))
+	if err != nil {
+		return toolFlags
+	}
+	args := strings.Split(strings.TrimSuffix(string(content), "\x00"), "\x00")
+	if len(args) < 2 || strings.TrimSuffix(filepath.Base(args[0]), ".exe") != "go" {
+		return toolFlags
+	}
+	return goBuildFlags(args[2:])
+}
+
+// Returns the flags of compileFlags among the arguments of a go command,
+// e.g. go test -race -gcflags "all=-N -l" ./... The arguments passed to the
+// test binary with -args are ignored
+func goBuildFlags(args []string) []string {
+	flags := make([]string, 0)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "-args" || arg == "--args" || arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name := strings.TrimLeft(arg, "-")
+		value := ""
+		hasValue := false
+		if idx := strings.Index(name, "="); idx >= 0 {
+			name, value, hasValue = name[:idx], name[idx+1:], true
+		}
+		if !compileFlags[name] {
+			continue
+		}
+		switch {
+		case hasValue:
+		case boolFlags[name]:
+			value, hasValue = "true", true
+		case i+1 < len(args):
+			value, hasValue = args[i+1], true
+			i++
+		}
+		if hasValue {
+			flags = append(flags, fmt.Sprintf("-%s=%s", name, value))
+		}
+	}
+	return flags
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"go/build"
+	. "launchpad.net/gocheck"
+	"os"
+	"path/filepath"
+)
+
+func (s *Mock4goTestSuite) TestToolexecLeavesTheStandardLibraryAlone(c *C) {
+	args := []string{"-o", "/work/b001/_pkg_.a", "-p", "fmt", "-std", "-importcfg", "/work/b001/importcfg", "-pack", "/goroot/src/fmt/print.go"}
+	newArgs, err := ToolexecArgs("/goroot/pkg/tool/linux_amd64/compile", args)
+	c.Assert(err, IsNil)
+	c.Assert(newArgs, DeepEquals, args)
+
+	newArgs, err = ToolexecArgs("/goroot/pkg/tool/linux_amd64/compile", []string{"-V=full"})
+	c.Assert(err, IsNil)
+	c.Assert(newArgs, DeepEquals, []string{"-V=full"})
+
+	newArgs, err = ToolexecArgs("/goroot/pkg/tool/linux_amd64/asm", []string{"-p", "foo", "foo.s"})
+	c.Assert(err, IsNil)
+	c.Assert(newArgs, DeepEquals, []string{"-p", "foo", "foo.s"})
+}
+
+func (s *Mock4goTestSuite) TestToolexecLeavesTheDependenciesAlone(c *C) {
+	modCache := os.Getenv("GOMODCACHE")
+	defer os.Setenv("GOMODCACHE", modCache)
+	os.Setenv("GOMODCACHE", "/home/user/go/pkg/mod")
+
+	c.Assert(isDependency("/home/user/go/pkg/mod/example.com/lib@v1.0.0/lib.go"), Equals, true)
+	c.Assert(isDependency("/src/app/vendor/example.com/lib/lib.go"), Equals, true)
+	c.Assert(isDependency("/src/app/lib/lib.go"), Equals, false)
+	c.Assert(isDependency("/home/user/go/pkg/module/lib.go"), Equals, false)
+}
+
+func (s *Mock4goTestSuite) TestToolexecDoesntRecurseThroughGOFLAGS(c *C) {
+	env := nestedEnv([]string{"HOME=/home/user", "GOFLAGS=-mod=mod -toolexec=mock4go --toolexec=/bin/mock4go -race"})
+	c.Assert(env, DeepEquals, []string{"HOME=/home/user", "GOFLAGS=-mod=mod -race", "MOCK4GO_TOOLEXEC_NESTED=1"})
+
+	os.Setenv(nestedToolexec, "1")
+	defer os.Unsetenv(nestedToolexec)
+	args := []string{"-o", "/work/b001/_pkg_.a", "-p", "foo", "-importcfg", "/work/b001/importcfg", "-pack", "/src/foo/foo.go"}
+	newArgs, err := ToolexecArgs("/goroot/pkg/tool/linux_amd64/compile", args)
+	c.Assert(err, IsNil)
+	c.Assert(newArgs, DeepEquals, args)
+	version, err := ToolVersion("compile version go1.21.0\n")
+	c.Assert(err, IsNil)
+	c.Assert(version, Equals, "compile version go1.21.0\n")
+}
+
+func (s *Mock4goTestSuite) TestToolexecForwardsTheBuildFlags(c *C) {
+	args := []string{"-count=1", "-gcflags", "all=-N -l", "--tags=foo,bar", "-race", "-trimpath=false", "-v", "./...", "-args", "-race"}
+	c.Assert(goBuildFlags(args), DeepEquals, []string{"-gcflags=all=-N -l", "-tags=foo,bar", "-race=true", "-trimpath=false"})
+}
+
+// the package is linked into every instrumented binary, importing testing
+// would add its flags to them
+func (s *Mock4goTestSuite) TestTheRuntimeDoesntImportTesting(c *C) {
+	pkg, err := build.ImportDir(".", 0)
+	c.Assert(err, IsNil)
+	for _, imported := range pkg.Imports {
+		c.Assert(imported, Not(Equals), "testing")
+	}
+}
+
+func (s *Mock4goTestSuite) TestToolexecExpandsResponseFiles(c *C) {
+	dir := c.MkDir()
+	nested := filepath.Join(dir, "nested")
+	c.Assert(os.WriteFile(nested, []byte("-std\n"), 0644), IsNil)
+	response := filepath.Join(dir, "args")
+	content := "-p\nmain\n\"/work/a b/x.go\"\n'it''s'\n\"a\\\\b\\\"c\\$\"\nd\\ e\\\nf\n\"\"\n@" + nested + "\n"
+	c.Assert(os.WriteFile(response, []byte(content), 0644), IsNil)
+
+	expanded, ok, err := expandResponseFiles([]string{"-o", "out.a", "@" + response})
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, true)
+	c.Assert(expanded, DeepEquals, []string{"-o", "out.a", "-p", "main", "/work/a b/x.go", "its", `a\b"c$`, "d ef", "", "-std"})
+
+	// the rewritten arguments are written to a new response file next to
+	// the new importcfg
+	work := c.MkDir()
+	importcfg := filepath.Join(work, "importcfg")
+	newArgs, err := withResponseFiles([]string{"@" + response}, func(args []string) ([]string, error) {
+		return append(args, "-importcfg", importcfg, "/work/mock4go/x $1.go"), nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(newArgs, HasLen, 1)
+	c.Assert(filepath.Dir(newArgs[0]), Equals, "@"+work)
+	rewritten, err := os.ReadFile(newArgs[0][1:])
+	c.Assert(err, IsNil)
+	c.Assert(parseResponseFile(rewritten), DeepEquals, append(expanded[2:], "-importcfg", importcfg, "/work/mock4go/x $1.go"))
+
+	// the arguments aren't changed, e.g. the package isn't instrumented
+	newArgs, err = withResponseFiles([]string{"@" + response}, func(args []string) ([]string, error) {
+		return args, nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(newArgs, DeepEquals, []string{"@" + response})
+}
@@ -1,7 +1,10 @@
 package api
 
 import (
+	"bytes"
 	"fmt"
+	"runtime"
+	"strconv"
 )
 
 var verbose = false
@@ -10,6 +13,19 @@ func SetVerbosity(isVerbose bool) {
 	verbose = isVerbose
 }
 
+// Returns the id of the current goroutine, the stack trace of the
+// goroutine starts with "goroutine <id> [running]:"
+func goroutineID() int64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	fields := bytes.Fields(buf)
+	id, err := strconv.ParseInt(string(fields[1]), 10, 64)
+	if err != nil {
+		panic(fmt.Sprintf("cannot parse the goroutine id from %q", buf))
+	}
+	return id
+}
+
 func Log(msg string, args ...interface{}) {
 	if verbose {
 		fmt.Printf(msg, args...)
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+)
+
+// Check that the values can be returned from the stubbed function and
+// convert them to the exact result types, e.g. the untyped constant 1 is
+// passed as an int and has to be converted to int64 if that's the result
+// type, otherwise the type assertion in the instrumented function panics
+func (m *functionCall) validateValues(name string, values []interface{}) ([]interface{}, bool) {
+	if m.fun == nil {
+		// returned by When without a recorded call, already reported
+		return nil, false
+	}
+	funType := reflect.TypeOf(m.fun)
+	if len(values) != funType.NumOut() {
+		m.fail("%s%s: expected %d values for %s but got %d", m.location(), name, funType.NumOut(), funcName(m.fun), len(values))
+		return nil, false
+	}
+	converted := make([]interface{}, 0, len(values))
+	for idx, value := range values {
+		resultType := funType.Out(idx)
+		value, err := convertValue(value, resultType)
+		if err != nil {
+			m.fail("%s%s: cannot use value %d as %s: %s", m.location(), name, idx, resultType, err)
+			return nil, false
+		}
+		converted = append(converted, value)
+	}
+	return converted, true
+}
+
+func convertValue(value interface{}, resultType reflect.Type) (interface{}, error) {
+	if value == nil {
+		switch resultType.Kind() {
+		case reflect.Interface, reflect.Ptr, reflect.Slice, reflect.Map, reflect.Chan, reflect.Func, reflect.UnsafePointer:
+			return nil, nil
+		}
+		return nil, fmt.Errorf("nil isn't a valid %s", resultType)
+	}
+
+	v := reflect.ValueOf(value)
+	if v.Type().AssignableTo(resultType) {
+		if resultType.Kind() == reflect.Interface {
+			return value, nil
+		}
+		return v.Convert(resultType).Interface(), nil
+	}
+	if isNumber(v.Type()) && isNumber(resultType) && v.Type().ConvertibleTo(resultType) {
+		// make sure the value doesn't overflow or lose precision
+		converted := v.Convert(resultType)
+		if converted.Convert(v.Type()).Interface() == value {
+			return converted.Interface(), nil
+		}
+		return nil, fmt.Errorf("%v overflows or loses precision", value)
+	}
+	return nil, fmt.Errorf("%#v of type %s isn't assignable to %s", value, v.Type(), resultType)
+}
+
+func isNumber(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
+		return true
+	}
+	return false
+}
+
+// the call site of When prefixed to the stubbing errors
+func (m *functionCall) location() string {
+	lock.Lock()
+	defer lock.Unlock()
+	if m.file == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d: ", m.file, m.line)
+}
+
+func caller(skip int) (string, int) {
+	_, file, line, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return "", 0
+	}
+	return file, line
+}
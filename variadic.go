@@ -0,0 +1,60 @@
+package api
+
+import (
+	"fmt"
+	"reflect"
+)
+
+type variadicMatcher struct {
+	matcher Matcher
+}
+
+// Variadic returns a Matcher that is applied to all the variadic
+// arguments of the call as a slice instead of matching them one by one.
+// It must be the last matcher, e.g.
+//
+//	When(Log("", nil)).WithMatchers(matchers.Eq("%s"), Variadic(matchers.Len(2)))
+func Variadic(matcher Matcher) Matcher {
+	return &variadicMatcher{matcher: matcher}
+}
+
+func (m *variadicMatcher) Matches(value interface{}) bool {
+	return m.matcher.Matches(value)
+}
+
+func (m *variadicMatcher) Describe() string {
+	return fmt.Sprintf("%s...", describeMatcher(m.matcher))
+}
+
+func endsWithVariadic(matchers []Matcher) bool {
+	if len(matchers) == 0 {
+		return false
+	}
+	_, ok := matchers[len(matchers)-1].(*variadicMatcher)
+	return ok
+}
+
+// Returns the arguments the matchers are applied to. The variadic
+// arguments are recorded as a slice and are matched one by one unless the
+// last matcher is a Variadic matcher, e.g. the arguments of
+// Log("%s", "foo", "bar") are matched by ("%s", "foo", "bar") or by
+// ("%s", Variadic(...))
+func expandArgs(fun function, matchers []Matcher, args []interface{}) []interface{} {
+	funType := reflect.TypeOf(fun)
+	if !funType.IsVariadic() || len(args) != funType.NumIn() {
+		return args
+	}
+	if len(matchers) == len(args) && endsWithVariadic(matchers) {
+		return args
+	}
+	tail := reflect.ValueOf(args[len(args)-1])
+	if tail.Kind() != reflect.Slice {
+		return args
+	}
+	expanded := make([]interface{}, 0, len(args)-1+tail.Len())
+	expanded = append(expanded, args[:len(args)-1]...)
+	for i := 0; i < tail.Len(); i++ {
+		expanded = append(expanded, tail.Index(i).Interface())
+	}
+	return expanded
+}
@@ -0,0 +1,240 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TestReporter is used to report verification failures, both *testing.T
+// and gocheck's *C implement it
+type TestReporter interface {
+	Errorf(format string, args ...interface{})
+}
+
+type verification struct {
+	registry *registry
+	funType  interface{}
+	fun      function
+	call     *functionCall
+	anyArgs  bool
+	reporter TestReporter
+}
+
+// Run the given function in verification mode, calls made to instrumented
+// functions inside fun are not executed, instead they are used with
+// Verify to assert how many times the function was called, e.g.
+//
+//	Verifying(c, func() {
+//	  Verify(Foo("x")).Times(2)
+//	})
+func Verifying(reporter TestReporter, fun func()) {
+	global.verifying(reporter, fun)
+}
+
+func (r *registry) verifying(reporter TestReporter, fun func()) {
+	defer stopRecording(startRecording(&recorder{registry: r, verifier: reporter}))
+	fun()
+}
+
+func Verify(args ...interface{}) *verification {
+	r := currentRecorder()
+	file, line := caller(1)
+	lock.Lock()
+	v := r.lastVerification
+	// a call to a function that isn't instrumented mustn't verify the
+	// previous one again
+	r.lastVerification = nil
+	lock.Unlock()
+	if v == nil {
+		// the verification has no function, it fails without checking
+		// the calls
+		call := &functionCall{reporter: r.verifier, file: file, line: line}
+		call.fail("%sVerify: no instrumented call recorded", call.location())
+		return &verification{registry: r.registry, call: call, reporter: r.verifier}
+	}
+	return v
+}
+
+func (v *verification) WithMatchers(matchers ...Matcher) *verification {
+	v.call.WithMatchers(matchers...)
+	return v
+}
+
+// Count all the calls to the function regardless of the arguments
+func (v *verification) AnyArguments() *verification {
+	v.anyArgs = true
+	return v
+}
+
+func (v *verification) Times(n int) bool {
+	return v.check(fmt.Sprintf("exactly %s", times(n)), func(count int) bool {
+		return count == n
+	})
+}
+
+func (v *verification) Once() bool {
+	return v.Times(1)
+}
+
+func (v *verification) Never() bool {
+	return v.Times(0)
+}
+
+func (v *verification) AtLeast(n int) bool {
+	return v.check(fmt.Sprintf("at least %s", times(n)), func(count int) bool {
+		return count >= n
+	})
+}
+
+func (v *verification) AtMost(n int) bool {
+	return v.check(fmt.Sprintf("at most %s", times(n)), func(count int) bool {
+		return count <= n
+	})
+}
+
+func (v *verification) matchingCalls(calls []*Call) []*Call {
+	lock.Lock()
+	matchers := v.call.args
+	lock.Unlock()
+
+	matching := make([]*Call, 0)
+	for _, call := range calls {
+		if v.anyArgs || matchArgs(matchers, call.matchedArguments(matchers)) {
+			matching = append(matching, call)
+		}
+	}
+	return matching
+}
+
+func (v *verification) String() string {
+	if v.anyArgs {
+		return fmt.Sprintf("%s(...)", funcName(v.fun))
+	}
+	return v.call.String()
+}
+
+func (v *verification) check(expected string, predicate func(int) bool) bool {
+	if v.fun == nil {
+		// Verify already reported the missing call
+		return false
+	}
+	defer pauseRecording()()
+	calls := v.registry.calls(v.fun)
+	matching := v.matchingCalls(calls)
+	count := len(matching)
+
+	lock.Lock()
+	matchers := v.call.args
+	lock.Unlock()
+
+	if !v.anyArgs {
+		for _, call := range matching {
+			captureArgs(matchers, call.matchedArguments(matchers))
+		}
+	}
+	if predicate(count) {
+		return true
+	}
+
+	actual := make([]string, 0)
+	for _, call := range calls {
+		actual = append(actual, "    "+call.String())
+		if v.anyArgs {
+			continue
+		}
+		for _, line := range explainMismatches(matchers, call) {
+			actual = append(actual, "        "+line)
+		}
+	}
+	if len(actual) == 0 {
+		actual = append(actual, "    none")
+	}
+
+	v.reporter.Errorf("expected %s to be called %s, but it was called %s\nactual calls:\n%s",
+		v, expected, times(count), strings.Join(actual, "\n"))
+	return false
+}
+
+func times(n int) string {
+	if n == 1 {
+		return "1 time"
+	}
+	return fmt.Sprintf("%d times", n)
+}
+
+// Assert that the given verifications matched calls in that order, other
+// calls may be made in between, e.g.
+//
+//	Verifying(c, func() {
+//		InOrder(c,
+//			Verify(Open("foo")),
+//			Verify(Write(nil)).WithMatchers(matchers.Any()),
+//			Verify(Close()),
+//		)
+//	})
+func InOrder(reporter TestReporter, verifications ...*verification) bool {
+	if len(verifications) == 0 {
+		return true
+	}
+	for _, v := range verifications {
+		if v.fun == nil {
+			// Verify already reported the missing call
+			return false
+		}
+	}
+	defer pauseRecording()()
+
+	lock.Lock()
+	journal := append([]*Call{}, verifications[0].registry.journal...)
+	matchers := make([][]Matcher, len(verifications))
+	funTypes := make(map[interface{}]bool)
+	for idx, v := range verifications {
+		matchers[idx] = v.call.args
+		funTypes[v.funType] = true
+	}
+	lock.Unlock()
+
+	next := 0
+	for _, call := range journal {
+		if next == len(verifications) {
+			break
+		}
+		v := verifications[next]
+		if call.funType != v.funType {
+			continue
+		}
+		if !v.anyArgs {
+			args := call.matchedArguments(matchers[next])
+			if !matchArgs(matchers[next], args) {
+				continue
+			}
+			captureArgs(matchers[next], args)
+		}
+		next++
+	}
+	if next == len(verifications) {
+		return true
+	}
+
+	expected := make([]string, 0, len(verifications))
+	for _, v := range verifications {
+		expected = append(expected, "    "+v.String())
+	}
+	actual := make([]string, 0)
+	for _, call := range journal {
+		if funTypes[call.funType] {
+			actual = append(actual, "    "+call.String())
+		}
+	}
+	if len(actual) == 0 {
+		actual = append(actual, "    none")
+	}
+	missing := fmt.Sprintf("%s wasn't called", verifications[next])
+	if next > 0 {
+		missing = fmt.Sprintf("%s wasn't called after %s", verifications[next], verifications[next-1])
+	}
+
+	reporter.Errorf("expected calls in order:\n%s\nbut %s\nactual calls:\n%s",
+		strings.Join(expected, "\n"), missing, strings.Join(actual, "\n"))
+	return false
+}